@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "gemserve_storage_cache_requests_total",
+	Help: "Reads served by the local storage cache, by result.",
+}, []string{"result"})
+
+// cacheSubdir is the directory, below the one configured, holding the
+// files of a CacheStorage.
+const cacheSubdir = "gemserve-cache"
+
+// CacheStorage keeps recently read objects of another Storage on local
+// disk, evicting the least recently used once maxSize bytes are cached.
+// Gems and their specs never change once pushed and are served from the
+// cache directly; other objects, such as the index, are revalidated by
+// ETag on every read. Each cached object is a data file
+// next to a JSON file describing it, so the cache survives restarts.
+type CacheStorage struct {
+	Storage
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	// lru orders the entries from most to least recently used
+	lru *list.List
+}
+
+type cacheEntry struct {
+	Key  string     `json:"key"`
+	Info ObjectInfo `json:"info"`
+	Sum  []byte     `json:"sha256"`
+	// path is the data file, described by path+".json"
+	path string
+}
+
+// NewCacheStorage returns a Storage caching up to maxSize bytes of backend
+// in a subdirectory of dir. Objects cached by a previous run are kept once
+// their checksum is verified.
+func NewCacheStorage(backend Storage, dir string, maxSize int64) (*CacheStorage, error) {
+	dir = filepath.Join(dir, cacheSubdir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &CacheStorage{
+		Storage: backend,
+		dir:     dir,
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load adds the objects cached in c.dir, least recently used first, and
+// removes any other file the cache left behind.
+func (c *CacheStorage) load() error {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	described := make(map[string]bool)
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(c.dir, strings.TrimSuffix(fi.Name(), ".json"))
+		entry, err := c.readEntry(path)
+		if err != nil {
+			logrus.WithError(err).WithField("path", path).Warn("discarding cached object")
+			os.Remove(path + ".json")
+			continue
+		}
+		described[filepath.Base(path)] = true
+		c.mu.Lock()
+		if el, ok := c.entries[entry.Key]; ok {
+			c.remove(el)
+		}
+		c.entries[entry.Key] = c.lru.PushFront(entry)
+		c.size += entry.Info.Size
+		c.mu.Unlock()
+	}
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), ".json") && !described[fi.Name()] {
+			os.Remove(filepath.Join(c.dir, fi.Name()))
+		}
+	}
+
+	c.mu.Lock()
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// readEntry reads the description of the data file at path and checks
+// the file against it.
+func (c *CacheStorage) readEntry(path string) (*cacheEntry, error) {
+	b, err := ioutil.ReadFile(path + ".json")
+	if err != nil {
+		return nil, err
+	}
+	entry := &cacheEntry{path: path}
+	if err := json.Unmarshal(b, entry); err != nil {
+		return nil, err
+	}
+	sum, err := fileSum(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(sum, entry.Sum) {
+		return nil, fmt.Errorf("checksum mismatch for %s", entry.Key)
+	}
+	return entry, nil
+}
+
+func fileSum(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// immutable reports whether the object at key never changes once written.
+func immutable(key string) bool {
+	for _, prefix := range []string{"gems/", "quick/", upstreamPrefix + "gems/"} {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stat always asks the backend, so that objects deleted through another
+// replica are not reported from the cache. Their cached copies are evicted.
+func (c *CacheStorage) Stat(key string) (*ObjectInfo, error) {
+	info, err := c.Storage.Stat(key)
+	if err == ErrObjectNotFound {
+		c.evict(key)
+	}
+	return info, err
+}
+
+func (c *CacheStorage) Get(key string) (io.ReadCloser, *ObjectInfo, error) {
+	return c.GetRange(key, 0)
+}
+
+func (c *CacheStorage) GetRange(key string, offset int64) (io.ReadCloser, *ObjectInfo, error) {
+	var etag string
+	if !immutable(key) {
+		info, err := c.Storage.Stat(key)
+		if err != nil {
+			c.evict(key)
+			return nil, nil, err
+		}
+		etag = info.ETag
+	}
+
+	f, info := c.open(key, etag)
+	if f != nil {
+		cacheRequests.WithLabelValues("hit").Inc()
+	} else {
+		cacheRequests.WithLabelValues("miss").Inc()
+		rc, rinfo, err := c.fill(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if rc != nil {
+			// too large to cache
+			if offset == 0 {
+				return rc, rinfo, nil
+			}
+			rc.Close()
+			return c.Storage.GetRange(key, offset)
+		}
+		if f, info = c.open(key, ""); f == nil {
+			return c.Storage.GetRange(key, offset)
+		}
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+// open returns the cached copy of key, if there is one with the etag.
+func (c *CacheStorage) open(key, etag string) (*os.File, *ObjectInfo) {
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil, nil
+	}
+	entry := el.Value.(*cacheEntry)
+	if etag != "" && entry.Info.ETag != etag {
+		c.remove(el)
+		c.mu.Unlock()
+		return nil, nil
+	}
+	c.lru.MoveToFront(el)
+	f, err := os.Open(entry.path)
+	c.mu.Unlock()
+	if err != nil {
+		c.evict(key)
+		return nil, nil
+	}
+	// the modification time orders the entries when the cache is loaded
+	now := time.Now()
+	os.Chtimes(entry.path+".json", now, now)
+	info := entry.Info
+	return f, &info
+}
+
+// fill copies key from the backend into the cache. Objects too large to
+// cache are returned open instead.
+func (c *CacheStorage) fill(key string) (io.ReadCloser, *ObjectInfo, error) {
+	rc, info, err := c.Storage.Get(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Size > c.maxSize {
+		return rc, info, nil
+	}
+	defer rc.Close()
+
+	f, err := ioutil.TempFile(c.dir, "object-")
+	if err != nil {
+		return nil, nil, err
+	}
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), rc)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	entry := &cacheEntry{Key: key, Info: *info, Sum: h.Sum(nil), path: f.Name()}
+	entry.Info.Size = size
+	if err == nil {
+		// the copy is verified once, so hits can be served without hashing
+		err = c.writeEntry(entry)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		os.Remove(f.Name() + ".json")
+		return nil, nil, err
+	}
+
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	for c.size+size > c.maxSize && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += size
+	c.mu.Unlock()
+	return nil, nil, nil
+}
+
+// writeEntry checks the data file of entry against its checksum and writes
+// its description.
+func (c *CacheStorage) writeEntry(entry *cacheEntry) error {
+	sum, err := fileSum(entry.path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, entry.Sum) {
+		return fmt.Errorf("checksum mismatch caching %s", entry.Key)
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(entry.path+".json", b, 0644)
+}
+
+// remove drops the entry from the cache. c.mu must be held.
+func (c *CacheStorage) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, entry.Key)
+	c.size -= entry.Info.Size
+	// readers holding the file open can still finish reading it
+	os.Remove(entry.path + ".json")
+	os.Remove(entry.path)
+}
+
+// evict drops key from the cache.
+func (c *CacheStorage) evict(key string) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.mu.Unlock()
+}
+
+// Size returns the number of bytes cached.
+func (c *CacheStorage) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+func (c *CacheStorage) Put(key string, r io.Reader, contentType string) (*ObjectInfo, error) {
+	defer c.evict(key)
+	return c.Storage.Put(key, r, contentType)
+}
+
+func (c *CacheStorage) PutIfMatch(key string, r io.Reader, contentType, etag string) (*ObjectInfo, error) {
+	defer c.evict(key)
+	return c.Storage.PutIfMatch(key, r, contentType, etag)
+}
+
+func (c *CacheStorage) Delete(key string) error {
+	defer c.evict(key)
+	return c.Storage.Delete(key)
+}
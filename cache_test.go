@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCacheStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend, _ := NewFileStorage(filepath.Join(dir, "store"))
+	// files of others in the configured directory are left alone
+	os.MkdirAll(filepath.Join(dir, "cache"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "cache", "keep"), nil, 0644)
+	cache, err := NewCacheStorage(backend, filepath.Join(dir, "cache"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(key string) string {
+		rc, info, err := cache.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		b, _ := ioutil.ReadAll(rc)
+		if info == nil || info.Size != int64(len(b)) {
+			t.Errorf("%s: expected object info; got %+v", key, info)
+		}
+		return string(b)
+	}
+
+	backend.Put("gems/a.gem", strings.NewReader("aaaa"), "")
+	read("gems/a.gem")
+	// gems are served from the cache without consulting the backend
+	backend.Put("gems/a.gem", strings.NewReader("AAAA"), "")
+	if got := read("gems/a.gem"); got != "aaaa" {
+		t.Errorf("expected cached gem; got %q", got)
+	}
+
+	// other objects are revalidated
+	backend.Put("index.json", strings.NewReader("[1]"), "")
+	read("index.json")
+	backend.Put("index.json", strings.NewReader("[1,2]"), "")
+	if got := read("index.json"); got != "[1,2]" {
+		t.Errorf("expected changed object to be refetched; got %q", got)
+	}
+
+	// deletions through other replicas are seen by Stat, which always
+	// asks the backend
+	backend.Delete("gems/a.gem")
+	if _, err := cache.Stat("gems/a.gem"); err != ErrObjectNotFound {
+		t.Errorf("expected deleted gem to be not found; got %v", err)
+	}
+	if _, ok := cache.entries["gems/a.gem"]; ok {
+		t.Error("expected deleted gem to be evicted")
+	}
+	backend.Put("gems/a.gem", strings.NewReader("aaaa"), "")
+	read("gems/a.gem")
+	backend.Put("gems/a.gem", strings.NewReader("AAAA"), "")
+
+	// the cache is kept across restarts
+	if cache, err = NewCacheStorage(backend, filepath.Join(dir, "cache"), 10); err != nil {
+		t.Fatal(err)
+	}
+	if got := read("gems/a.gem"); got != "aaaa" {
+		t.Errorf("expected gem cached before the restart; got %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cache", "keep")); err != nil {
+		t.Errorf("expected other files to be kept: %v", err)
+	}
+
+	// corrupt cached copies are discarded when the cache is loaded
+	files, _ := filepath.Glob(filepath.Join(dir, "cache", cacheSubdir, "object-*[0-9]"))
+	for _, f := range files {
+		ioutil.WriteFile(f, []byte("xxxx"), 0644)
+	}
+	if cache, err = NewCacheStorage(backend, filepath.Join(dir, "cache"), 10); err != nil {
+		t.Fatal(err)
+	}
+	if got := read("gems/a.gem"); got != "AAAA" {
+		t.Errorf("expected corrupt copy to be refetched; got %q", got)
+	}
+
+	backend.Put("gems/b.gem", strings.NewReader("bbbbbb"), "")
+	read("gems/b.gem")
+	if cache.Size() > 10 {
+		t.Errorf("expected cache to stay within its size; got %d", cache.Size())
+	}
+	if _, ok := cache.entries["index.json"]; ok {
+		t.Error("expected least recently used object to be evicted")
+	}
+
+	rc, _, err := cache.GetRange("gems/b.gem", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(b) != "bb" {
+		t.Errorf("expected range of cached object; got %q", b)
+	}
+}
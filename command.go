@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// runCommand runs the maintenance subcommand named by args[0].
+func runCommand(idx *Index, args []string) error {
+	switch args[0] {
+	case "reindex":
+		flags := flag.NewFlagSet("reindex", flag.ExitOnError)
+		dryRun := flags.Bool("dry-run", false, "print the changes without writing the index")
+		flags.Parse(args[1:])
+		diff, err := idx.Reindex(*dryRun)
+		if err != nil {
+			return err
+		}
+		return printJSON(diff)
+	case "fsck":
+		flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+		repair := flags.Bool("repair", false, "repair the problems found")
+		flags.Parse(args[1:])
+		report, err := idx.Fsck(*repair)
+		if err != nil {
+			return err
+		}
+		if err := printJSON(report); err != nil {
+			return err
+		}
+		if !*repair && !report.Clean() {
+			return errors.New("index and storage are inconsistent")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// reindexHandler rebuilds the index from stored gems on POST, reporting the
+// changes. With dry_run=true the index is left untouched.
+func reindexHandler(idx *Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+		dryRun, _ := strconv.ParseBool(req.URL.Query().Get("dry_run"))
+		diff, err := idx.Reindex(dryRun)
+		if err != nil {
+			logrus.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(diff)
+	}
+}
+
+// fsckHandler checks the index against the stored gems. Problems are
+// repaired on POST with repair=true.
+func fsckHandler(idx *Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		repair, _ := strconv.ParseBool(req.URL.Query().Get("repair"))
+		if repair && req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "repair requires POST", http.StatusMethodNotAllowed)
+			return
+		}
+		report, err := idx.Fsck(repair)
+		if err != nil {
+			logrus.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// purgeUpstreamCacheHandler removes the upstream file named by the path
+// parameter from the cache on DELETE, or every file without one.
+func purgeUpstreamCacheHandler(cache *metadataCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodDelete {
+			w.Header().Set("Allow", http.MethodDelete)
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+		purged := cache.Purge(req.URL.Query().Get("path"))
+		logrus.WithField("count", len(purged)).Info("purged upstream cache")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]string{"purged": purged})
+	}
+}
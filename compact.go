@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// fetchVersionsHandler serves the compact index /versions file for the gems in index.
+func fetchVersionsHandler(index *Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var buf bytes.Buffer
+		modified := index.Modified()
+		if err := writeVersions(&buf, index.Deps(), modified); err != nil {
+			logrus.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		serveCompactIndex(w, req, modified, buf.Bytes())
+	}
+}
+
+// fetchNamesHandler serves the compact index /names file for the gems in index.
+func fetchNamesHandler(index *Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var buf bytes.Buffer
+		if err := writeNames(&buf, index.Deps()); err != nil {
+			logrus.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		serveCompactIndex(w, req, index.Modified(), buf.Bytes())
+	}
+}
+
+// fetchInfoHandler serves the compact index /info/<name> file for the gems in index.
+// The gem name is expected to be the remaining request path.
+func fetchInfoHandler(index *Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		deps := index.Lookup(req.URL.Path)
+		if len(deps) == 0 {
+			http.NotFound(w, req)
+			return
+		}
+		var buf bytes.Buffer
+		if err := writeInfo(&buf, deps); err != nil {
+			logrus.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		serveCompactIndex(w, req, index.Modified(), buf.Bytes())
+	}
+}
+
+// fetchMergedVersionsHandler serves the upstream versions file with the
+// versions of the gems in index inserted after its header. Upstream lines
+// for gems in the private namespace are dropped, so only the private
+// versions are listed. Upstream only ever appends to its versions file, so
+// with the private lines ahead of the upstream ones the merged file grows
+// at its end as well, and Bundler can keep fetching just the new lines by
+// range; pushes and yanks change the file before its end, and make Bundler
+// download it whole again.
+func fetchMergedVersionsHandler(up *upstreamSet, index *Index, policy *namespacePolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		body, stale, err := up.Versions()
+		if err != nil {
+			logrus.Error(err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		body, shadowed := filterVersions(body, policy.Filter())
+		logShadowed(shadowed...)
+		header, lines := versionsHeader(body)
+		buf := bytes.NewBuffer(nil)
+		buf.Write(header)
+		private := index.Deps()
+		byName := groupByName(private)
+		for _, name := range gemNames(private) {
+			deps := byName[name]
+			buf.WriteString(versionsLine(name, deps, mergeInfo(nil, deps)))
+		}
+		buf.Write(lines)
+		if stale {
+			w.Header().Set("Warning", staleWarning)
+		}
+		serveCompactIndex(w, req, time.Time{}, buf.Bytes())
+	}
+}
+
+// versionsHeader splits a versions file after the "---" line ending its
+// header.
+func versionsHeader(body []byte) (header, lines []byte) {
+	if bytes.HasPrefix(body, []byte("---\n")) {
+		return body[:4], body[4:]
+	}
+	if n := bytes.Index(body, []byte("\n---\n")); n >= 0 {
+		return body[:n+5], body[n+5:]
+	}
+	return body, nil
+}
+
+// filterVersions removes the lines of gems matching private from a
+// versions file, returning the names removed.
+func filterVersions(body []byte, private func(name string) bool) ([]byte, []string) {
+	var (
+		buf      bytes.Buffer
+		shadowed []string
+		header   = true
+	)
+	for _, line := range bytes.SplitAfter(body, []byte("\n")) {
+		if header {
+			buf.Write(line)
+			header = string(line) != "---\n"
+			continue
+		}
+		if n := bytes.IndexByte(line, ' '); n > 0 && private(string(line[:n])) {
+			if name := string(line[:n]); !stringInSlice(name, shadowed) {
+				shadowed = append(shadowed, name)
+			}
+			continue
+		}
+		buf.Write(line)
+	}
+	return buf.Bytes(), shadowed
+}
+
+// fetchMergedInfoHandler serves the upstream info file for a gem with the
+// versions of the gem in index appended. Gems in the private namespace are
+// served from index alone.
+func fetchMergedInfoHandler(up *upstreamSet, index *Index, policy *namespacePolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		name := req.URL.Path
+		if !gemNamePattern.MatchString(name) {
+			http.Error(w, ErrInvalidGemName.Error(), http.StatusBadRequest)
+			return
+		}
+		deps := index.Lookup(name)
+		if len(deps) > 0 || policy.Reserved(name) {
+			if len(deps) == 0 {
+				http.NotFound(w, req)
+				return
+			}
+			serveCompactIndex(w, req, time.Time{}, mergeInfo(nil, deps))
+			return
+		}
+
+		body, stale, err := up.Info(name)
+		if err == ErrUpstreamNotFound {
+			http.NotFound(w, req)
+			return
+		}
+		if err != nil {
+			logrus.Error(err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if stale {
+			w.Header().Set("Warning", staleWarning)
+		}
+		serveCompactIndex(w, req, time.Time{}, body)
+	}
+}
+
+// mergeInfo appends the info lines for deps to an upstream info file.
+// A nil upstream file results in the info file for deps alone.
+func mergeInfo(upstream []byte, deps []Metadata) []byte {
+	var buf bytes.Buffer
+	if upstream == nil {
+		writeInfo(&buf, deps)
+		return buf.Bytes()
+	}
+	buf.Write(upstream)
+	if len(upstream) > 0 && upstream[len(upstream)-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+	for _, md := range deps {
+		buf.WriteString(infoLine(md))
+	}
+	return buf.Bytes()
+}
+
+// serveCompactIndex writes body with the digest headers Bundler uses to
+// validate incremental (byte-range) updates of its local copy.
+func serveCompactIndex(w http.ResponseWriter, req *http.Request, modified time.Time, body []byte) {
+	sum := sha256.Sum256(body)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("ETag", `"`+md5Hex(body)+`"`)
+	w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+	w.Header().Set("Cache-Control", "max-age=60, public")
+	http.ServeContent(w, req, "", modified, bytes.NewReader(body))
+}
+
+// writeNames writes the sorted unique names of deps.
+func writeNames(w io.Writer, deps []Metadata) error {
+	names := gemNames(deps)
+	if _, err := io.WriteString(w, "---\n"); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := io.WriteString(w, name+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeVersions writes a versions file listing every version of deps
+// along with the checksum of the gem's info file.
+func writeVersions(w io.Writer, deps []Metadata, created time.Time) error {
+	if _, err := fmt.Fprintf(w, "created_at: %s\n---\n", created.UTC().Format(time.RFC3339)); err != nil {
+		return err
+	}
+	byName := groupByName(deps)
+	for _, name := range gemNames(deps) {
+		deps := byName[name]
+		if _, err := io.WriteString(w, versionsLine(name, deps, mergeInfo(nil, deps))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// versionsLine returns the versions file line for the versions of a single
+// gem, where info is the gem's info file.
+func versionsLine(name string, deps []Metadata, info []byte) string {
+	versions := make([]string, len(deps))
+	for i, md := range deps {
+		versions[i] = compactVersion(md)
+	}
+	return fmt.Sprintf("%s %s %s\n", name, strings.Join(versions, ","), md5Hex(info))
+}
+
+// writeInfo writes the info file for deps, which are all versions of a single gem.
+func writeInfo(w io.Writer, deps []Metadata) error {
+	if _, err := io.WriteString(w, "---\n"); err != nil {
+		return err
+	}
+	for _, md := range deps {
+		if _, err := io.WriteString(w, infoLine(md)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// infoLine returns the info file line describing a single gem version.
+func infoLine(md Metadata) string {
+	deps := make([]string, 0, len(md.Dependencies))
+	for _, dep := range md.Dependencies {
+		if len(dep) != 2 {
+			continue
+		}
+		deps = append(deps, dep[0]+":"+strings.Replace(dep[1], ", ", "&", -1))
+	}
+	var reqs []string
+	if md.Checksum != "" {
+		reqs = append(reqs, "checksum:"+md.Checksum)
+	}
+	if md.Spec != nil {
+		if r := md.Spec.RequiredRubyVersion; !r.IsDefault() {
+			reqs = append(reqs, "ruby:"+strings.Join(r.Strings(), "&"))
+		}
+		if r := md.Spec.RequiredRubygemsVersion; !r.IsDefault() {
+			reqs = append(reqs, "rubygems:"+strings.Join(r.Strings(), "&"))
+		}
+	}
+	line := compactVersion(md) + " " + strings.Join(deps, ",")
+	if len(reqs) > 0 {
+		line += "|" + strings.Join(reqs, ",")
+	}
+	return line + "\n"
+}
+
+// parseInfo parses the info file of the gem name into the versions it lists.
+func parseInfo(name string, body []byte) ([]Metadata, error) {
+	var deps []Metadata
+	for n, line := range strings.Split(string(body), "\n") {
+		if line == "" || line == "---" {
+			continue
+		}
+		md, err := parseInfoLine(name, line)
+		if err != nil {
+			return nil, fmt.Errorf("info %s line %d: %s", name, n+1, err)
+		}
+		deps = append(deps, md)
+	}
+	return deps, nil
+}
+
+// parseInfoLine parses a line of the form
+//
+//	<version>[-<platform>] <dep>:<req>&<req>,...|<key>:<value>,...
+func parseInfoLine(name, line string) (Metadata, error) {
+	fields := strings.SplitN(line, " ", 2)
+	if len(fields) != 2 {
+		return Metadata{}, errors.New("missing dependencies")
+	}
+	md := Metadata{Name: name, Platform: "ruby"}
+	md.Number = fields[0]
+	if i := strings.Index(md.Number, "-"); i >= 0 {
+		md.Number, md.Platform = md.Number[:i], md.Number[i+1:]
+	}
+
+	parts := strings.SplitN(fields[1], "|", 2)
+	if parts[0] != "" {
+		for _, dep := range strings.Split(parts[0], ",") {
+			d := strings.SplitN(dep, ":", 2)
+			if len(d) != 2 {
+				return Metadata{}, fmt.Errorf("malformed dependency %q", dep)
+			}
+			md.Dependencies = append(md.Dependencies, []string{d[0], strings.Replace(d[1], "&", ", ", -1)})
+		}
+	}
+	if len(parts) == 2 {
+		for _, req := range strings.Split(parts[1], ",") {
+			if strings.HasPrefix(req, "checksum:") {
+				md.Checksum = strings.TrimPrefix(req, "checksum:")
+			}
+		}
+	}
+	return md, nil
+}
+
+// compactVersion returns the version as written in the compact index,
+// suffixed by the platform for platform specific gems.
+func compactVersion(md Metadata) string {
+	if normalizePlatform(md.Platform) == "ruby" {
+		return md.Number
+	}
+	return md.Number + "-" + md.Platform
+}
+
+func groupByName(deps []Metadata) map[string][]Metadata {
+	byName := make(map[string][]Metadata)
+	for _, md := range deps {
+		byName[md.Name] = append(byName[md.Name], md)
+	}
+	return byName
+}
+
+func gemNames(deps []Metadata) []string {
+	var names []string
+	for name := range groupByName(deps) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func md5Hex(b []byte) string {
+	sum := md5.Sum(b)
+	return hex.EncodeToString(sum[:])
+}
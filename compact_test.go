@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseInfo(t *testing.T) {
+	body := []byte("---\n1.0 bar:>= 1&< 2,baz:= 1|checksum:abc,ruby:>= 2.0\n1.1-x86_64-linux |checksum:def\n")
+	deps, err := parseInfo("foo", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deps) != 2 {
+		t.Fatalf("expected 2 versions; got %d", len(deps))
+	}
+
+	if deps[0].Number != "1.0" || deps[0].Platform != "ruby" || deps[0].Checksum != "abc" {
+		t.Errorf("invalid version: %+v", deps[0])
+	}
+	if len(deps[0].Dependencies) != 2 {
+		t.Fatalf("expected 2 dependencies; got %d", len(deps[0].Dependencies))
+	}
+	if dep := deps[0].Dependencies[0]; dep[0] != "bar" || dep[1] != ">= 1, < 2" {
+		t.Errorf("invalid dependency: %q", dep)
+	}
+	if deps[1].Number != "1.1" || deps[1].Platform != "x86_64-linux" || len(deps[1].Dependencies) != 0 {
+		t.Errorf("invalid version: %+v", deps[1])
+	}
+
+	lines := []string{"1.0 bar:>= 1&< 2,baz:= 1|checksum:abc\n", "1.1-x86_64-linux |checksum:def\n"}
+	for i, md := range deps {
+		if line := infoLine(md); line != lines[i] {
+			t.Errorf("invalid info line; got: %q expected %q", line, lines[i])
+		}
+	}
+}
+
+func TestParseInfoMalformed(t *testing.T) {
+	if _, err := parseInfo("foo", []byte("---\n1.0\n")); err == nil {
+		t.Error("expected error for line without dependencies")
+	}
+	if _, err := parseInfo("foo", []byte("---\n1.0 bar|checksum:abc\n")); err == nil {
+		t.Error("expected error for dependency without requirement")
+	}
+}
+
+func TestCompactIndexHandlers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStorage(dir)
+	idx, _ := LoadIndex(store, DependencyAPIEndpoint)
+	idx.Put(Metadata{Name: "foo", Number: "1.0.0", Platform: "ruby", Checksum: "abc", Dependencies: [][]string{{"bar", ">= 1, < 2"}}})
+	idx.Put(Metadata{Name: "foo", Number: "1.1.0", Platform: "x86_64-linux", Checksum: "def"})
+	idx.Put(Metadata{Name: "bar", Number: "1.0.0", Platform: "ruby"})
+
+	get := func(handler http.HandlerFunc, path string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.URL.Path = path
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	info := "---\n1.0.0 bar:>= 1&< 2|checksum:abc\n1.1.0-x86_64-linux |checksum:def\n"
+	w := get(fetchInfoHandler(idx), "foo", nil)
+	if body := w.Body.String(); body != info {
+		t.Errorf("invalid info file; got %q expected %q", body, info)
+	}
+	sum := md5.Sum([]byte(info))
+	if etag := w.Header().Get("ETag"); etag != `"`+hex.EncodeToString(sum[:])+`"` {
+		t.Errorf("invalid ETag %s", etag)
+	}
+	digest := sha256.Sum256([]byte(info))
+	if d := w.Header().Get("Repr-Digest"); d != "sha-256=:"+base64.StdEncoding.EncodeToString(digest[:])+":" {
+		t.Errorf("invalid Repr-Digest %s", d)
+	}
+	if w := get(fetchInfoHandler(idx), "missing", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown gem; got %d", w.Code)
+	}
+
+	w = get(fetchInfoHandler(idx), "foo", map[string]string{"Range": "bytes=4-"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != info[4:] {
+		t.Errorf("invalid range response; got %d %q", w.Code, w.Body.String())
+	}
+
+	if body := get(fetchNamesHandler(idx), "/names", nil).Body.String(); body != "---\nbar\nfoo\n" {
+		t.Errorf("invalid names file; got %q", body)
+	}
+
+	body := get(fetchVersionsHandler(idx), "/versions", nil).Body.String()
+	lines := strings.SplitAfter(body, "---\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "created_at: ") {
+		t.Fatalf("invalid versions header; got %q", body)
+	}
+	barInfo := md5.Sum([]byte("---\n1.0.0 \n"))
+	versions := "bar 1.0.0 " + hex.EncodeToString(barInfo[:]) + "\nfoo 1.0.0,1.1.0-x86_64-linux " + hex.EncodeToString(sum[:]) + "\n"
+	if lines[1] != versions {
+		t.Errorf("invalid versions; got %q expected %q", lines[1], versions)
+	}
+}
+
+func TestMergedVersionsChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStorage(dir)
+	idx, _ := LoadIndex(store, DependencyAPIEndpoint)
+	idx.Put(Metadata{Name: "foo", Number: "1.0.0", Platform: "ruby", Checksum: "abc"})
+
+	rackInfo := "---\n2.0.0 |checksum:def\n"
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/versions":
+			sum := md5.Sum([]byte(rackInfo))
+			w.Write([]byte("created_at: 2017-01-01T00:00:00Z\n---\nrack 2.0.0 " + hex.EncodeToString(sum[:]) + "\n"))
+		case "/info/rack":
+			w.Write([]byte(rackInfo))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer source.Close()
+	up := &upstreamSet{sources: []*upstream{{base: source.URL}}}
+	policy := &namespacePolicy{index: idx}
+
+	w := httptest.NewRecorder()
+	fetchMergedVersionsHandler(up, idx, policy)(w, httptest.NewRequest("GET", "/versions", nil))
+	checksums := make(map[string]string)
+	for _, line := range strings.Split(strings.SplitAfter(w.Body.String(), "---\n")[1], "\n") {
+		if fields := strings.Fields(line); len(fields) == 3 {
+			checksums[fields[0]] = fields[2]
+		}
+	}
+
+	for _, name := range []string{"foo", "rack"} {
+		req := httptest.NewRequest("GET", "/info/"+name, nil)
+		req.URL.Path = name
+		w := httptest.NewRecorder()
+		fetchMergedInfoHandler(up, idx, policy)(w, req)
+		sum := md5.Sum(w.Body.Bytes())
+		if checksums[name] != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s: versions checksum %q does not match the info file %q", name, checksums[name], w.Body.String())
+		}
+	}
+}
+
+func TestMergedVersionsRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStorage(dir)
+	idx, _ := LoadIndex(store, DependencyAPIEndpoint)
+	idx.Put(Metadata{Name: "foo", Number: "1.0.0", Platform: "ruby", Checksum: "abc"})
+
+	versions := "created_at: 2017-01-01T00:00:00Z\n---\nrack 2.0.0 aaa\n"
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(versions))
+	}))
+	defer source.Close()
+	up := &upstreamSet{sources: []*upstream{{base: source.URL}}}
+	handler := fetchMergedVersionsHandler(up, idx, &namespacePolicy{index: idx})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/versions", nil))
+	local := w.Body.String()
+
+	// Bundler fetches the lines appended since, starting from the last
+	// byte it has
+	versions += "rack 2.0.1 bbb\n"
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/versions", nil))
+	full := w.Body.String()
+
+	req := httptest.NewRequest("GET", "/versions", nil)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(local)-1))
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("expected 206; got %d", w.Code)
+	}
+	if updated := local[:len(local)-1] + w.Body.String(); updated != full {
+		t.Errorf("expected the range to complete the file; got %q expected %q", updated, full)
+	}
+}
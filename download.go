@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// redirector returns the URL to redirect a download of key to.
+type redirector func(key string) (string, error)
+
+// Presigner is implemented by storages that can grant temporary access to
+// an object through a URL.
+type Presigner interface {
+	// PresignGet returns a URL downloading key that is valid for ttl.
+	PresignGet(key string, ttl time.Duration) (string, error)
+}
+
+// presignRedirect redirects downloads to presigned URLs valid for ttl.
+func presignRedirect(p Presigner, ttl time.Duration) redirector {
+	return func(key string) (string, error) {
+		return p.PresignGet(key, ttl)
+	}
+}
+
+// cdnRedirect redirects downloads to the same key below base, such as a
+// CDN in front of the storage.
+func cdnRedirect(base string) redirector {
+	base = strings.TrimSuffix(base, "/")
+	return func(key string) (string, error) {
+		return base + "/" + key, nil
+	}
+}
+
+// redirectObject redirects to the object at key, once it is known to exist.
+func redirectObject(w http.ResponseWriter, r *http.Request, store Storage, key string, redirect redirector) error {
+	if _, err := store.Stat(key); err != nil {
+		return err
+	}
+	target, err := redirect(key)
+	if err != nil {
+		return err
+	}
+	// presigned URLs expire, so the redirect must not outlive them
+	w.Header().Set("Cache-Control", "no-cache")
+	http.Redirect(w, r, target, http.StatusFound)
+	return nil
+}
+
+// serveStored serves the object at key, or redirects to it when redirect is
+// set.
+func serveStored(w http.ResponseWriter, r *http.Request, store Storage, key string, redirect redirector) error {
+	if redirect != nil {
+		return redirectObject(w, r, store, key, redirect)
+	}
+	return serveObject(w, r, store, key)
+}
+
+// serveObject serves the object at key with its stored attributes, handling
+// HEAD, conditional and range requests. Nothing is written if the object
+// cannot be found, so the caller can respond instead.
+func serveObject(w http.ResponseWriter, r *http.Request, store Storage, key string) error {
+	info, err := store.Stat(key)
+	if err != nil {
+		return err
+	}
+	body := &objectReader{store: store, key: key, size: info.Size}
+	defer body.Close()
+
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	if info.ETag != "" {
+		w.Header().Set("ETag", info.ETag)
+	}
+	http.ServeContent(w, r, "", info.LastModified, body)
+	return nil
+}
+
+// objectReader is an io.ReadSeeker over a stored object. The object is only
+// fetched once read, from the current offset, so seeking to serve a range
+// does not download the bytes before it.
+type objectReader struct {
+	store  Storage
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *objectReader) Read(p []byte) (int, error) {
+	if o.body == nil {
+		if o.offset >= o.size {
+			return 0, io.EOF
+		}
+		body, _, err := o.store.GetRange(o.key, o.offset)
+		if err != nil {
+			return 0, err
+		}
+		o.body = body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of object")
+	}
+	if offset != o.offset {
+		o.Close()
+		o.offset = offset
+	}
+	return offset, nil
+}
+
+func (o *objectReader) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFetchGemHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStorage(dir)
+	info, _ := store.Put("gems/foo-1.0.0.gem", strings.NewReader("0123456789"), "")
+	handler := fetchGemHandler(store, nil, nil)
+
+	tests := []struct {
+		method string
+		header map[string]string
+		status int
+		body   string
+	}{
+		{"GET", nil, http.StatusOK, "0123456789"},
+		{"HEAD", nil, http.StatusOK, ""},
+		{"GET", map[string]string{"Range": "bytes=2-4"}, http.StatusPartialContent, "234"},
+		{"GET", map[string]string{"Range": "bytes=-3"}, http.StatusPartialContent, "789"},
+		{"GET", map[string]string{"If-None-Match": info.ETag}, http.StatusNotModified, ""},
+		{"POST", nil, http.StatusMethodNotAllowed, "\n"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/gems/foo-1.0.0.gem", nil)
+		for k, v := range test.header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != test.status || rec.Body.String() != test.body {
+			t.Errorf("%s %v: expected %d %q; got %d %q", test.method, test.header, test.status, test.body, rec.Code, rec.Body.String())
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/gems/foo-1.0.0.gem", nil))
+	for k, v := range map[string]string{
+		"Content-Length": "10",
+		"Content-Type":   "application/octet-stream",
+		"ETag":           info.ETag,
+		"Accept-Ranges":  "bytes",
+	} {
+		if got := rec.Header().Get(k); got != v {
+			t.Errorf("expected %s %q; got %q", k, v, got)
+		}
+	}
+	if rec.Header().Get("Last-Modified") == "" {
+		t.Error("expected Last-Modified")
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/gems/bar-1.0.0.gem", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected missing gem to be not found; got %d", rec.Code)
+	}
+}
+
+func TestFetchGemHandlerRedirect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStorage(dir)
+	store.Put("gems/foo-1.0.0.gem", strings.NewReader("0123456789"), "")
+	handler := fetchGemHandler(store, cdnRedirect("https://cdn.example.com/"), nil)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/gems/foo-1.0.0.gem", nil))
+	if loc := rec.Header().Get("Location"); rec.Code != http.StatusFound || loc != "https://cdn.example.com/gems/foo-1.0.0.gem" {
+		t.Errorf("expected redirect to cdn; got %d %q", rec.Code, loc)
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/gems/bar-1.0.0.gem", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected missing gem to be not found; got %d", rec.Code)
+	}
+}
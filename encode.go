@@ -49,6 +49,32 @@ func (r *rubyEncoder) EndHash() error {
 	return r.do(func() error { return r.gen.EndHash() })
 }
 
+func (r *rubyEncoder) StartUserMarshalled(name string) error {
+	return r.do(func() error { return r.gen.StartUserMarshalled(name) })
+}
+func (r *rubyEncoder) EndUserMarshalled() error {
+	return r.do(func() error { return r.gen.EndUserMarshalled() })
+}
+
+func (r *rubyEncoder) StartObject(name string, len int) error {
+	return r.do(func() error { return r.gen.StartObject(name, len) })
+}
+func (r *rubyEncoder) EndObject() error {
+	return r.do(func() error { return r.gen.EndObject() })
+}
+func (r *rubyEncoder) UserDefinedObject(name, data string) error {
+	return r.do(func() error { return r.gen.UserDefinedObject(name, data) })
+}
+func (r *rubyEncoder) Fixnum(n int64) error {
+	return r.do(func() error { return r.gen.Fixnum(n) })
+}
+func (r *rubyEncoder) Bool(b bool) error {
+	return r.do(func() error { return r.gen.Bool(b) })
+}
+func (r *rubyEncoder) Nil() error {
+	return r.do(func() error { return r.gen.Nil() })
+}
+
 func (r *rubyEncoder) Err() error {
 	return r.err
 }
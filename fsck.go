@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// quarantinePrefix holds the objects removed by fsck repairs.
+const quarantinePrefix = "quarantine/"
+
+// FsckReport lists the inconsistencies found between the index and the
+// stored gems. Gems are identified by full name, objects by key.
+type FsckReport struct {
+	// Missing lists indexed gems without a stored .gem
+	Missing []string `json:"missing"`
+	// Orphaned lists stored .gem objects without an index entry
+	Orphaned []string `json:"orphaned"`
+	// Mismatched lists index entries that differ from their stored .gem
+	Mismatched []string `json:"mismatched"`
+	// Duplicates lists gems indexed more than once
+	Duplicates []string `json:"duplicates"`
+	// Unreadable lists stored objects that are not valid gems
+	Unreadable []string `json:"unreadable"`
+	// Unchecked lists index entries without a checksum to check their
+	// stored .gem against, which reindex fills in
+	Unchecked []string `json:"unchecked"`
+}
+
+// Clean reports whether no inconsistencies were found.
+func (r *FsckReport) Clean() bool {
+	return len(r.Missing) == 0 && len(r.Orphaned) == 0 && len(r.Mismatched) == 0 && len(r.Duplicates) == 0
+}
+
+// Fsck checks the index against the stored gems. With repair, missing and
+// duplicate entries are dropped, mismatched entries are replaced with the
+// metadata of the stored gem and orphaned objects, as left behind by failed
+// pushes, are moved below quarantinePrefix. Nothing is deleted:
+// a quarantined gem is restored by moving it back and reindexing. Use
+// Reindex instead to recover a lost index.
+func (i *Index) Fsck(repair bool) (*FsckReport, error) {
+	raw, _, err := i.read()
+	if _, ok := err.(corruptIndexError); ok {
+		return nil, fmt.Errorf("%v: run reindex to rebuild it", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	current, dups := dedupeMetadata(raw)
+	stored, unreadable, err := i.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	diff := diffIndex(current, stored)
+	report := &FsckReport{
+		Missing:    diff.Removed,
+		Mismatched: diff.Changed,
+		Unreadable: unreadable,
+		Unchecked:  diff.Backfill,
+	}
+	for _, name := range diff.Added {
+		pushing, err := i.pushing(name)
+		if err != nil {
+			return nil, err
+		}
+		if pushing {
+			// published but not yet indexed
+			continue
+		}
+		report.Orphaned = append(report.Orphaned, gemKey(name))
+	}
+	for _, gem := range dups {
+		report.Duplicates = append(report.Duplicates, gem.FullName())
+	}
+	if !repair || report.Clean() {
+		return report, nil
+	}
+
+	byName := make(map[string]Metadata, len(stored))
+	for _, md := range stored {
+		byName[md.FullName()] = md
+	}
+	var orphans []Metadata
+	i.mu.Lock()
+	err = i.update(func() error {
+		// the index may have changed since it was checked, so every
+		// problem is confirmed against the latest one before repairing it
+		orphans = orphans[:0]
+		indexed := make(map[string]bool, len(i.gems))
+		gems := i.gems[:0]
+		for _, gem := range i.gems {
+			md, ok := byName[gem.FullName()]
+			if !ok {
+				if _, err := i.store.Stat(gemKey(gem.FullName())); err == ErrObjectNotFound {
+					logrus.WithField("gem", gem.FullName()).Warn("fsck: dropping entry without gem")
+					continue
+				} else if err != nil {
+					return err
+				}
+			} else if stringInSlice(gem.FullName(), report.Mismatched) {
+				logrus.WithField("gem", gem.FullName()).Warn("fsck: replacing mismatched entry")
+				gem = md
+			}
+			gems = append(gems, gem)
+			indexed[gem.FullName()] = true
+		}
+		i.gems = gems
+		for _, md := range stored {
+			if !indexed[md.FullName()] && stringInSlice(gemKey(md.FullName()), report.Orphaned) {
+				orphans = append(orphans, md)
+			}
+		}
+		return nil
+	})
+	i.mu.Unlock()
+	if err != nil {
+		return report, err
+	}
+
+	for _, md := range orphans {
+		logrus.WithField("key", gemKey(md.FullName())).Warn("fsck: quarantining orphaned gem")
+		for _, key := range []string{gemKey(md.FullName()), gemspecKey(md.FullName())} {
+			if err := i.quarantine(key); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
+
+// quarantine moves the object at key below quarantinePrefix.
+func (i *Index) quarantine(key string) error {
+	if err := i.copy(key, quarantinePrefix); err != nil {
+		return err
+	}
+	return i.store.Delete(key)
+}
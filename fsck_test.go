@@ -0,0 +1,122 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// buildGem packages the metadata fixture as a .gem file.
+func buildGem(t *testing.T, fixture string) []byte {
+	metadata, err := ioutil.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(metadata)
+	zw.Close()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "metadata.gz", Mode: 0644, Size: int64(gz.Len())})
+	tw.Write(gz.Bytes())
+	tw.Close()
+	return buf.Bytes()
+}
+
+func TestIndexFsck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStorage(dir)
+	idx, _ := LoadIndex(store, DependencyAPIEndpoint)
+
+	raw := buildGem(t, "testdata/sinatra-metadata.yaml")
+	gem, err := LoadGem(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an orphaned object, as left by a failed push
+	store.Put(gemKey(gem.FullName()), bytes.NewReader(raw), "")
+	// an entry for a gem that was never stored
+	idx.Put(Metadata{Name: "foo", Number: "1.0.0", Platform: "ruby"})
+
+	report, err := idx.Fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Missing) != 1 || report.Missing[0] != "foo-1.0.0" {
+		t.Errorf("expected foo-1.0.0 to be missing; got %v", report.Missing)
+	}
+	if len(report.Orphaned) != 1 || report.Orphaned[0] != "gems/sinatra-2.0.0.gem" {
+		t.Errorf("expected sinatra to be orphaned; got %v", report.Orphaned)
+	}
+
+	if _, err := idx.Fsck(true); err != nil {
+		t.Fatal(err)
+	}
+	if report, _ = idx.Fsck(false); !report.Clean() {
+		t.Errorf("expected repaired index to be clean; got %+v", report)
+	}
+	if len(idx.Deps()) != 0 {
+		t.Errorf("expected missing entry to be dropped; got %+v", idx.Deps())
+	}
+	if _, err := store.Stat(gemKey(gem.FullName())); err != ErrObjectNotFound {
+		t.Errorf("expected orphaned gem to be removed; got %v", err)
+	}
+	if info, err := store.Stat(quarantinePrefix + gemKey(gem.FullName())); err != nil || info.Size != int64(len(raw)) {
+		t.Errorf("expected orphaned gem to be quarantined; got %+v %v", info, err)
+	}
+}
+
+func TestIndexFsckWithoutChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStorage(dir)
+	idx, _ := LoadIndex(store, DependencyAPIEndpoint)
+
+	raw := buildGem(t, "testdata/sinatra-metadata.yaml")
+	gem, err := LoadGem(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idx.Push(gem, bytes.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+	// an entry written before checksums were recorded
+	md := idx.Lookup("sinatra")[0]
+	md.Checksum = ""
+	idx.Delete(md.Name, md.Number, md.Platform)
+	idx.Put(md)
+
+	report, err := idx.Fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Clean() || len(report.Mismatched) != 0 {
+		t.Errorf("expected entry without checksum not to be mismatched; got %+v", report)
+	}
+	if len(report.Unchecked) != 1 || report.Unchecked[0] != "sinatra-2.0.0" {
+		t.Errorf("expected entry without checksum to be unchecked; got %v", report.Unchecked)
+	}
+
+	diff, err := idx.Reindex(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Changed) != 0 || len(diff.Backfill) != 1 {
+		t.Errorf("expected reindex to backfill the checksum; got %+v", diff)
+	}
+	if md := idx.Lookup("sinatra")[0]; md.Checksum != gem.Checksum {
+		t.Errorf("expected backfilled checksum %s; got %s", gem.Checksum, md.Checksum)
+	}
+}
@@ -2,27 +2,41 @@ package main
 
 import (
 	"archive/tar"
-	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
 	"io/ioutil"
 )
 
 type Gem struct {
-	raw []byte
 	Metadata
 }
 
-func LoadGem(raw []byte) (*Gem, error) {
-	var gem Gem
-	gem.raw = raw[:]
-	tr := tar.NewReader(bytes.NewReader(gem.raw))
+// LoadGem reads a gem file from r, parsing its metadata from the tar stream
+// and computing the checksum of the whole file.
+func LoadGem(r io.Reader) (*Gem, error) {
+	var (
+		gem   Gem
+		found bool
+		h     = sha256.New()
+		tee   = io.TeeReader(r, h)
+		tr    = tar.NewReader(tee)
+	)
 	for {
 		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
 			return &gem, err
 		}
 		if header.Name == "metadata.gz" {
-			gzr, _ := gzip.NewReader(tr)
+			gzr, err := gzip.NewReader(tr)
+			if err != nil {
+				return &gem, err
+			}
 			b, err := ioutil.ReadAll(gzr)
 			if err != nil {
 				return &gem, err
@@ -31,8 +45,26 @@ func LoadGem(raw []byte) (*Gem, error) {
 			if err != nil {
 				return &gem, err
 			}
-			break
+			found = true
 		}
 	}
+	if !found {
+		return &gem, errors.New("invalid gem: missing metadata.gz")
+	}
+	// the checksum covers the padding after the end of the archive
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		return &gem, err
+	}
+	gem.Checksum = hex.EncodeToString(h.Sum(nil))
 	return &gem, nil
 }
+
+// gemKey returns the storage key of the gem file with the full name.
+func gemKey(fullName string) string {
+	return "gems/" + fullName + ".gem"
+}
+
+// gemspecKey returns the storage key of the quick gemspec with the full name.
+func gemspecKey(fullName string) string {
+	return "quick/Marshal.4.8/" + fullName + ".gemspec.rz"
+}
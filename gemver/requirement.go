@@ -0,0 +1,115 @@
+package gemver
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var constraintPattern = regexp.MustCompile(`^\s*(=|!=|>|<|>=|<=|~>)?\s*(` + versionPattern + `)\s*$`)
+
+// Constraint is a single operator and version pair, e.g. "~> 1.2".
+type Constraint struct {
+	Op      string
+	Version *Version
+}
+
+// String returns the constraint as written in a Gemfile.
+func (c Constraint) String() string {
+	return c.Op + " " + c.Version.String()
+}
+
+// Satisfied reports whether v meets the constraint.
+func (c Constraint) Satisfied(v *Version) bool {
+	switch c.Op {
+	case "=":
+		return v.Compare(c.Version) == 0
+	case "!=":
+		return v.Compare(c.Version) != 0
+	case ">":
+		return v.Compare(c.Version) > 0
+	case "<":
+		return v.Compare(c.Version) < 0
+	case ">=":
+		return v.Compare(c.Version) >= 0
+	case "<=":
+		return v.Compare(c.Version) <= 0
+	case "~>":
+		return v.Compare(c.Version) >= 0 && v.Release().Compare(c.Version.Bump()) < 0
+	}
+	return false
+}
+
+// Requirement is a Gem::Requirement, satisfied when all of its constraints are.
+type Requirement struct {
+	Constraints []Constraint
+}
+
+// ParseConstraint parses a constraint such as ">= 1.0". A missing operator means "=".
+func ParseConstraint(s string) (Constraint, error) {
+	m := constraintPattern.FindStringSubmatch(s)
+	if m == nil {
+		return Constraint{}, fmt.Errorf("illformed requirement %q", s)
+	}
+	op := m[1]
+	if op == "" {
+		op = "="
+	}
+	v, err := Parse(m[2])
+	if err != nil {
+		return Constraint{}, err
+	}
+	return Constraint{Op: op, Version: v}, nil
+}
+
+// ParseRequirement parses each of reqs, which may themselves hold several
+// comma separated constraints as in "> 1.0, < 2". No constraints means ">= 0".
+func ParseRequirement(reqs ...string) (*Requirement, error) {
+	r := &Requirement{}
+	for _, req := range reqs {
+		for _, s := range strings.Split(req, ",") {
+			if strings.TrimSpace(s) == "" {
+				continue
+			}
+			c, err := ParseConstraint(s)
+			if err != nil {
+				return nil, err
+			}
+			r.Constraints = append(r.Constraints, c)
+		}
+	}
+	if len(r.Constraints) == 0 {
+		r.Constraints = []Constraint{{Op: ">=", Version: MustParse("0")}}
+	}
+	return r, nil
+}
+
+// Satisfied reports whether v meets every constraint of the requirement.
+func (r *Requirement) Satisfied(v *Version) bool {
+	for _, c := range r.Constraints {
+		if !c.Satisfied(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// Prerelease reports whether any constraint names a prerelease version,
+// in which case prerelease versions may satisfy the requirement.
+func (r *Requirement) Prerelease() bool {
+	for _, c := range r.Constraints {
+		if c.Version.Prerelease() {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the constraints joined by ", ".
+func (r *Requirement) String() string {
+	s := make([]string, len(r.Constraints))
+	for i, c := range r.Constraints {
+		s[i] = c.String()
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,233 @@
+// Package gemver implements RubyGems version and requirement semantics.
+package gemver
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	versionPattern  = `[0-9]+(\.[0-9a-zA-Z]+)*(-[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*)?`
+	anchoredPattern = regexp.MustCompile(`^\s*(` + versionPattern + `)?\s*$`)
+	segmentPattern  = regexp.MustCompile(`[0-9]+|[a-zA-Z]+`)
+)
+
+// segment is a numeric or string part of a version. Numeric segments are
+// kept as digits without leading zeros, as RubyGems allows numbers of any
+// size.
+type segment struct {
+	str     string
+	numeric bool
+}
+
+func (s segment) String() string {
+	return s.str
+}
+
+func (s segment) isZero() bool {
+	return s.numeric && s.str == "0"
+}
+
+// compare orders numeric segments after string segments, as Gem::Version does.
+func (s segment) compare(o segment) int {
+	switch {
+	case s.numeric && o.numeric:
+		return compareDigits(s.str, o.str)
+	case s.numeric:
+		return 1
+	case o.numeric:
+		return -1
+	}
+	return strings.Compare(s.str, o.str)
+}
+
+// Version is a parsed Gem::Version.
+type Version struct {
+	original  string
+	segments  []segment
+	canonical []segment
+}
+
+// Parse parses a version string. As in RubyGems, a "-" is read as ".pre."
+// and an empty string is version "0".
+func Parse(s string) (*Version, error) {
+	if !anchoredPattern.MatchString(s) {
+		return nil, fmt.Errorf("malformed version number string %q", s)
+	}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		s = "0"
+	}
+	v := &Version{original: s}
+	for _, part := range segmentPattern.FindAllString(strings.Replace(s, "-", ".pre.", -1), -1) {
+		if part[0] >= '0' && part[0] <= '9' {
+			v.segments = append(v.segments, numericSegment(part))
+		} else {
+			v.segments = append(v.segments, segment{str: part})
+		}
+	}
+	v.canonical = canonicalize(v.segments)
+	return v, nil
+}
+
+// MustParse is like Parse but panics if the version cannot be parsed.
+func MustParse(s string) *Version {
+	v, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// Valid reports whether s is a well formed version string.
+func Valid(s string) bool {
+	return anchoredPattern.MatchString(s)
+}
+
+// canonicalize drops the trailing zeros of the numeric and string parts of
+// segments, so that "1.0" and "1" compare equal.
+func canonicalize(segments []segment) []segment {
+	split := len(segments)
+	for i, s := range segments {
+		if !s.numeric {
+			split = i
+			break
+		}
+	}
+	canonical := trimZeros(segments[:split])
+	return append(canonical, trimZeros(segments[split:])...)
+}
+
+func trimZeros(segments []segment) []segment {
+	n := len(segments)
+	for n > 0 && segments[n-1].isZero() {
+		n--
+	}
+	return append([]segment(nil), segments[:n]...)
+}
+
+// String returns the version as it was given.
+func (v *Version) String() string {
+	return v.original
+}
+
+// Prerelease reports whether the version contains a letter, e.g. "1.0.0.rc1".
+func (v *Version) Prerelease() bool {
+	for _, s := range v.segments {
+		if !s.numeric {
+			return true
+		}
+	}
+	return false
+}
+
+// Release returns the version without its prerelease segments.
+func (v *Version) Release() *Version {
+	if !v.Prerelease() {
+		return v
+	}
+	var parts []string
+	for _, s := range v.segments {
+		if !s.numeric {
+			break
+		}
+		parts = append(parts, s.String())
+	}
+	return MustParse(strings.Join(parts, "."))
+}
+
+// Bump returns the version the "~>" operator compares against, e.g. 5.3.1
+// bumps to 5.4 and 5.3 bumps to 6.
+func (v *Version) Bump() *Version {
+	var parts []string
+	for _, s := range v.segments {
+		if !s.numeric {
+			break
+		}
+		parts = append(parts, s.String())
+	}
+	if len(parts) > 1 {
+		parts = parts[:len(parts)-1]
+	}
+	parts[len(parts)-1] = incrementDigits(parts[len(parts)-1])
+	return MustParse(strings.Join(parts, "."))
+}
+
+// Compare returns -1, 0 or 1 as v sorts before, equal to or after o.
+func (v *Version) Compare(o *Version) int {
+	l, r := v.canonical, o.canonical
+	limit := len(l)
+	if len(r) > limit {
+		limit = len(r)
+	}
+	zero := numericSegment("0")
+	for i := 0; i < limit; i++ {
+		lhs, rhs := zero, zero
+		if i < len(l) {
+			lhs = l[i]
+		}
+		if i < len(r) {
+			rhs = r[i]
+		}
+		if c := lhs.compare(rhs); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// Equal reports whether v and o are the same version once trailing zeros are ignored.
+func (v *Version) Equal(o *Version) bool {
+	return v.Compare(o) == 0
+}
+
+// Compare parses and compares two version strings. Malformed versions sort
+// before well formed ones and are compared with each other as strings.
+func Compare(a, b string) int {
+	av, aerr := Parse(a)
+	bv, berr := Parse(b)
+	switch {
+	case aerr == nil && berr == nil:
+		return av.Compare(bv)
+	case aerr == nil:
+		return 1
+	case berr == nil:
+		return -1
+	}
+	return strings.Compare(a, b)
+}
+
+func numericSegment(digits string) segment {
+	digits = strings.TrimLeft(digits, "0")
+	if digits == "" {
+		digits = "0"
+	}
+	return segment{str: digits, numeric: true}
+}
+
+// compareDigits compares two numbers written as digits without leading
+// zeros: the longer is larger, and numbers of the same length compare as
+// strings.
+func compareDigits(a, b string) int {
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// incrementDigits adds one to a number written as digits.
+func incrementDigits(digits string) string {
+	b := []byte(digits)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] != '9' {
+			b[i]++
+			return string(b)
+		}
+		b[i] = '0'
+	}
+	return "1" + string(b)
+}
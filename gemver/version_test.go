@@ -0,0 +1,74 @@
+package gemver
+
+import "testing"
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0.0", 0},
+		{"1.10", "1.9", 1},
+		{"1.0.0.rc1", "1.0.0", -1},
+		{"1.0.a", "1.0.b", -1},
+		{"1-pre", "1", -1},
+		{"2.0.0.pre.1", "2.0.0.pre", 1},
+		{"0.9", "1.0.0.beta", -1},
+		{"1.20240101123456789012", "1.0", 1},
+		{"1.20240101123456789012", "1.20240101123456789013", -1},
+		{"1.010", "1.10", 0},
+	}
+	for _, tt := range tests {
+		if got := Compare(tt.a, tt.b); got != tt.want {
+			t.Errorf("Compare(%q, %q) = %d; expected %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+	if MustParse("1.20240101123456789012").Prerelease() {
+		t.Error("expected a large numeric segment not to make a prerelease")
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, s := range []string{"1..0", "a.1", "1.0 beta"} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q) expected error", s)
+		}
+	}
+}
+
+func TestBump(t *testing.T) {
+	tests := map[string]string{"5.3.1": "5.4", "5.3": "6", "5": "6", "1.0.0.rc1": "1.1", "9.99.1": "9.100", "99999999999999999999.1": "100000000000000000000"}
+	for v, want := range tests {
+		if got := MustParse(v).Bump().String(); got != want {
+			t.Errorf("%q bump = %q; expected %q", v, got, want)
+		}
+	}
+}
+
+func TestRequirementSatisfied(t *testing.T) {
+	tests := []struct {
+		req, version string
+		want         bool
+	}{
+		{"~> 3.2.1", "3.2.0", false},
+		{"~> 3.2.1", "3.2.9", true},
+		{"~> 3.2.1", "3.3", false},
+		{"~> 3.2", "3.9", true},
+		{">= 6.0, < 8", "5.2", false},
+		{">= 6.0, < 8", "7.1.3", true},
+		{">= 6.0, < 8", "8.0", false},
+		{"!= 1.0", "1.0.0", false},
+		{"1.0", "1.0", true},
+		{"", "0.1", true},
+	}
+	for _, tt := range tests {
+		r, err := ParseRequirement(tt.req)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if got := r.Satisfied(MustParse(tt.version)); got != tt.want {
+			t.Errorf("%q satisfied by %q = %t; expected %t", tt.req, tt.version, got, tt.want)
+		}
+	}
+}
@@ -5,117 +5,168 @@ import (
 	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"math/rand"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mattaitchison/gemserve/gemver"
 )
 
 // LoadIndex of ruby gems from key
-func LoadIndex(svc *s3.S3, bucket, key string) (*Index, error) {
-	var index = &Index{
-		svc:    svc,
-		bucket: bucket,
-		key:    key,
-	}
+func LoadIndex(store Storage, key string) (*Index, error) {
+	index := newIndex(store, key)
 	return index, index.Refresh()
 }
 
+// newIndex returns the index of ruby gems at key without loading it, for
+// commands that must work on an index that cannot be loaded.
+func newIndex(store Storage, key string) *Index {
+	return &Index{
+		store: store,
+		key:   key,
+	}
+}
+
+// maxIndexAttempts bounds the attempts to save an index that keeps
+// changing concurrently.
+const maxIndexAttempts = 10
+
 type Index struct {
-	svc    *s3.S3
-	bucket string
-	key    string
-	gems   []Metadata
-	mu     sync.Mutex
+	store Storage
+	key   string
+	gems  []Metadata
+	// etag identifies the persisted index the in memory index was read from
+	etag string
+	// checked is the last time the index was known to match the persisted index
+	checked time.Time
+	// modified is the last time the persisted index changed
+	modified time.Time
+	// specs caches the generated legacy index files
+	specs map[string][]byte
+	mu    sync.Mutex
 }
 
 func (i *Index) keyJSON() string {
 	return i.key + ".json"
 }
 
-func (i *Index) find(name, version string) (int, *Metadata) {
+func (i *Index) find(name, version, platform string) (int, *Metadata) {
+	platform = normalizePlatform(platform)
 	for idx, gem := range i.gems {
-		if gem.Name == name && gem.Number == version {
+		if gem.Name == name && gem.Number == version && normalizePlatform(gem.Platform) == platform {
 			return idx, &gem
 		}
 	}
 	return -1, nil
 }
 
-// Delete gem by name and version from index
-func (i *Index) Delete(name, version string) error {
+// Delete gem by name, version and platform from index
+func (i *Index) Delete(name, version, platform string) error {
 	i.mu.Lock()
 	defer i.mu.Unlock()
-	if err := i.refresh(); err != nil {
-		return err
-	}
-
-	idx, md := i.find(name, version)
-	if md == nil {
-		return errors.New("gem not found")
-	}
-	// delete from gems
-	i.gems = append(i.gems[:idx], i.gems[idx+1:]...)
-	return i.save()
+	return i.update(func() error {
+		idx, md := i.find(name, version, platform)
+		if md == nil {
+			return errors.New("gem not found")
+		}
+		// delete from gems
+		i.gems = append(i.gems[:idx], i.gems[idx+1:]...)
+		return nil
+	})
 }
 
 // Put gem in index
 func (i *Index) Put(gem Metadata) error {
 	i.mu.Lock()
 	defer i.mu.Unlock()
-	if err := i.refresh(); err != nil {
-		return err
-	}
-	if err := i.put(gem); err != nil {
-		return err
+	return i.update(func() error {
+		return i.put(gem)
+	})
+}
+
+// update applies fn to the latest persisted index and saves the result.
+// The save only succeeds if no other replica wrote the index since it was
+// read; otherwise fn is applied again to the newer index, so concurrent
+// writes are merged rather than lost.
+func (i *Index) update(fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		if err := i.refresh(); err != nil {
+			return err
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+		err := i.save()
+		if err != ErrPreconditionFailed || attempt == maxIndexAttempts {
+			return err
+		}
+		logrus.WithField("attempt", attempt).Warn("index changed concurrently, retrying")
+		time.Sleep(time.Duration(attempt*50+rand.Intn(100)) * time.Millisecond)
 	}
-	return i.save()
 }
 
 func (i *Index) put(gem Metadata) error {
-	if _, res := i.find(gem.Name, gem.Number); res != nil {
+	gem.Platform = normalizePlatform(gem.Platform)
+	if _, res := i.find(gem.Name, gem.Number, gem.Platform); res != nil {
 		return ErrDuplicateGem
 	}
 	i.gems = append(i.gems, gem)
+	sortMetadata(i.gems)
 	return nil
 }
 
+// sortMetadata orders deps by name, then version and platform.
+func sortMetadata(deps []Metadata) {
+	sort.SliceStable(deps, func(i, j int) bool {
+		a, b := deps[i], deps[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if c := gemver.Compare(a.Number, b.Number); c != 0 {
+			return c < 0
+		}
+		return a.Platform < b.Platform
+	})
+}
+
 func (i *Index) save() error {
+	i.specs = nil
 	return i.saveJSON()
 }
 
 func (i *Index) saveJSON() error {
+	info, err := i.write(i.gems, i.etag)
+	if err != nil {
+		return err
+	}
+	i.etag = info.ETag
+	i.modified = time.Now()
+	i.checked = time.Now()
+	return nil
+}
+
+// write persists gems if the persisted index still has the given etag.
+func (i *Index) write(gems []Metadata, etag string) (*ObjectInfo, error) {
 	var buf bytes.Buffer
 	enc := json.NewEncoder(&buf)
 	enc.SetEscapeHTML(false)
-	if err := enc.Encode(i.gems); err != nil {
-		return err
+	if err := enc.Encode(gems); err != nil {
+		return nil, err
 	}
-
-	_, err := i.svc.PutObject(&s3.PutObjectInput{
-		Bucket:      aws.String(i.bucket),
-		Key:         aws.String(i.keyJSON()),
-		Body:        bytes.NewReader(buf.Bytes()),
-		ContentType: aws.String("application/json"),
-	})
-	return err
+	return i.store.PutIfMatch(i.keyJSON(), bytes.NewReader(buf.Bytes()), "application/json", etag)
 }
 
 func (i *Index) saveRuby() error {
 	var buf bytes.Buffer
 	writeDeps(&buf, i.Deps())
 
-	_, err := i.svc.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(i.bucket),
-		Key:    aws.String(i.key),
-		Body:   bytes.NewReader(buf.Bytes()),
-	})
+	_, err := i.store.Put(i.key, bytes.NewReader(buf.Bytes()), "")
 	return err
 }
 
-// Refresh in memory index with s3 persisted json index
+// Refresh in memory index with the persisted json index
 func (i *Index) Refresh() error {
 	i.mu.Lock()
 	err := i.refresh()
@@ -124,40 +175,102 @@ func (i *Index) Refresh() error {
 }
 
 func (i *Index) refresh() error {
-	log := logrus.WithFields(logrus.Fields{
-		"bucket": i.bucket,
-		"key":    i.keyJSON(),
-	})
-
-	log.WithField("count", len(i.gems)).Debug("refreshing gem index")
-	defer func() {
-		log.WithField("count", len(i.gems)).Info("index refresh complete")
-	}()
-	res, err := i.svc.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(i.bucket),
-		Key:    aws.String(i.keyJSON()),
-	})
+	gems, info, err := i.load()
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
-			return nil
-		}
 		return err
 	}
+	i.apply(gems, info)
+	return nil
+}
 
-	body, _ := ioutil.ReadAll(res.Body)
-	res.Body.Close()
+// load reads the persisted index, dropping duplicate entries. A nil info
+// is returned when no index has been persisted yet.
+func (i *Index) load() ([]Metadata, *ObjectInfo, error) {
+	md, info, err := i.read()
+	if err != nil {
+		return nil, info, err
+	}
+	log := logrus.WithField("key", i.keyJSON())
+	gems, dups := dedupeMetadata(md)
+	for _, gem := range dups {
+		log.WithField("gem", gem.FullName()).Warn("skipping duplicate gem")
+	}
+	for _, gem := range gems {
+		log.WithField("gem", gem.FullName()).Debug("indexed gem")
+	}
+	sortMetadata(gems)
+	return gems, info, nil
+}
+
+// read returns the entries of the persisted index as stored. An index that
+// cannot be parsed is reported as a corruptIndexError, along with its info.
+func (i *Index) read() ([]Metadata, *ObjectInfo, error) {
+	logrus.WithField("key", i.keyJSON()).Debug("loading gem index")
+
+	rc, info, err := i.store.Get(i.keyJSON())
+	if err == ErrObjectNotFound {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, nil, err
+	}
 
 	var md []Metadata
 	if err := json.Unmarshal(body, &md); err != nil {
-		return err
+		return nil, info, corruptIndexError{err}
 	}
+	return md, info, nil
+}
+
+// corruptIndexError is a persisted index that is not valid JSON.
+type corruptIndexError struct {
+	err error
+}
 
+func (e corruptIndexError) Error() string {
+	return "corrupt index: " + e.err.Error()
+}
+
+// dedupeMetadata normalizes platforms and splits md into the first entry
+// for each full name and the entries repeating one.
+func dedupeMetadata(md []Metadata) (gems, dups []Metadata) {
+	gems = make([]Metadata, 0, len(md))
+	seen := make(map[string]bool, len(md))
 	for _, gem := range md {
-		i.put(gem)
-		log.WithField("gem", gem.Name+"-"+gem.Number).Debug("indexed gem")
+		gem.Platform = normalizePlatform(gem.Platform)
+		if seen[gem.FullName()] {
+			dups = append(dups, gem)
+			continue
+		}
+		seen[gem.FullName()] = true
+		gems = append(gems, gem)
 	}
+	return
+}
 
-	return nil
+// apply replaces the in memory index with a loaded one, rather than
+// merging, so deletes by other replicas are seen.
+func (i *Index) apply(gems []Metadata, info *ObjectInfo) {
+	i.gems, i.etag, i.specs = gems, "", nil
+	if info != nil {
+		i.etag = info.ETag
+		if !info.LastModified.IsZero() {
+			i.modified = info.LastModified
+		}
+	}
+	if i.modified.IsZero() {
+		i.modified = time.Now()
+	}
+	i.checked = time.Now()
+	logrus.WithFields(logrus.Fields{
+		"key":   i.keyJSON(),
+		"count": len(i.gems),
+	}).Info("index refresh complete")
 }
 
 func (i *Index) Deps() (deps []Metadata) {
@@ -167,6 +280,63 @@ func (i *Index) Deps() (deps []Metadata) {
 	return
 }
 
+// Modified returns the last time the index changed
+func (i *Index) Modified() time.Time {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.modified
+}
+
+// Specs returns the gzipped legacy index file, generating it if the index
+// changed since it was last requested. Nil is returned for unknown files.
+func (i *Index) Specs(file string) ([]byte, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if b, ok := i.specs[file]; ok {
+		return b, nil
+	}
+	selected := selectSpecs(file, i.gems)
+	if selected == nil {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	if err := writeSpecs(&buf, selected); err != nil {
+		return nil, err
+	}
+	if i.specs == nil {
+		i.specs = make(map[string][]byte)
+	}
+	i.specs[file] = buf.Bytes()
+	return buf.Bytes(), nil
+}
+
+// Satisfying returns the versions of the named gem that meet req, oldest first.
+// Prereleases are only included when req names a prerelease version.
+func (i *Index) Satisfying(name string, req *gemver.Requirement) (deps []Metadata) {
+	for _, gem := range i.Lookup(name) {
+		v, err := gemver.Parse(gem.Number)
+		if err != nil || (v.Prerelease() && !req.Prerelease()) {
+			continue
+		}
+		if req.Satisfied(v) {
+			deps = append(deps, gem)
+		}
+	}
+	return
+}
+
+// Latest returns the highest release version of the named gem, or nil if
+// the gem has no releases.
+func (i *Index) Latest(name string) *Metadata {
+	all, _ := gemver.ParseRequirement()
+	deps := i.Satisfying(name, all)
+	if len(deps) == 0 {
+		return nil
+	}
+	return &deps[len(deps)-1]
+}
+
 // Lookup from index names, returning their deps
 func (i *Index) Lookup(names ...string) (deps []Metadata) {
 	i.mu.Lock()
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestIndexConcurrentPut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStorage(dir)
+
+	// each index stands in for a separate replica
+	var replicas []*Index
+	for n := 0; n < 3; n++ {
+		idx, err := LoadIndex(store, DependencyAPIEndpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replicas = append(replicas, idx)
+	}
+
+	var wg sync.WaitGroup
+	for n := 0; n < 30; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			gem := Metadata{Name: "foo", Number: fmt.Sprintf("1.0.%d", n), Platform: "ruby"}
+			if err := replicas[n%len(replicas)].Put(gem); err != nil {
+				t.Error(err)
+			}
+		}(n)
+	}
+	wg.Wait()
+
+	idx, err := LoadIndex(store, DependencyAPIEndpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deps := idx.Deps(); len(deps) != 30 {
+		t.Errorf("expected 30 gems; got %d", len(deps))
+	}
+}
+
+func TestIndexSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStorage(dir)
+
+	a, _ := LoadIndex(store, DependencyAPIEndpoint)
+	b, _ := LoadIndex(store, DependencyAPIEndpoint)
+	if err := a.Put(Metadata{Name: "foo", Number: "1.0.0", Platform: "ruby"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Deps()) != 0 {
+		t.Fatal("expected replica to be stale before sync")
+	}
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if deps := b.Deps(); len(deps) != 1 || deps[0].Number != "1.0.0" {
+		t.Errorf("expected synced gem; got %+v", deps)
+	}
+
+	if err := a.Delete("foo", "1.0.0", "ruby"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if deps := b.Deps(); len(deps) != 0 {
+		t.Errorf("expected deleted gem to be removed; got %+v", deps)
+	}
+}
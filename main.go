@@ -1,26 +1,26 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/gregjones/httpcache"
+	"github.com/mattaitchison/gemserve/gemver"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -29,14 +29,33 @@ var (
 	BuildTime string
 )
 
-var ErrDuplicateGem = errors.New("gem with same name and version already exists")
+var (
+	ErrDuplicateGem       = errors.New("gem with same name, version and platform already exists")
+	ErrUpstreamNotFound   = errors.New("not found in upstream gem source")
+	ErrObjectNotFound     = errors.New("object not found")
+	ErrPreconditionFailed = errors.New("object was modified concurrently")
+	ErrTooManyGems        = fmt.Errorf("too many gems requested, at most %d are allowed", maxDepsGems)
+	ErrInvalidGemName     = errors.New("invalid gem name")
+)
 
 const (
-	defaultServerPort  = "3000"
-	defaultMetricsPort = "9258"
-	defaultGemSource   = "https://api.rubygems.org"
+	defaultServerPort   = "3000"
+	defaultMetricsPort  = "9258"
+	defaultGemSource    = "https://api.rubygems.org"
+	defaultPollInterval = 10 * time.Second
+	defaultMaxGemSize   = 100 << 20
+	defaultRedirectTTL  = 5 * time.Minute
+	defaultCacheSize    = 1 << 30
+
+	defaultUpstreamTimeout  = 10 * time.Second
+	defaultUpstreamCacheTTL = time.Minute
+	defaultUpstreamCacheSWR = time.Hour
+	defaultUpstreamCacheMax = 512 << 20
+	upstreamJanitorInterval = time.Hour
 
 	DependencyAPIEndpoint = "/api/v1/dependencies"
+	// maxDepsGems caps the gems of a dependency API request, as RubyGems does
+	maxDepsGems = 200
 )
 
 func main() {
@@ -47,6 +66,7 @@ func main() {
 	}).Info("starting")
 	var (
 		bucket      = os.Getenv("S3_BUCKET")
+		storageDir  = os.Getenv("STORAGE_DIR")
 		enableProxy = os.Getenv("ENABLE_PROXY")
 		serverPort  string
 		metricsPort string
@@ -60,36 +80,180 @@ func main() {
 		metricsPort = defaultMetricsPort
 	}
 
-	gemSource, err := url.Parse(defaultGemSource)
-	if err != nil {
-		logrus.WithError(err).Fatal("invalid gem source")
-		return
+	var (
+		store Storage
+		err   error
+	)
+	if storageDir != "" {
+		if store, err = NewFileStorage(storageDir); err != nil {
+			logrus.WithError(err).Fatal("invalid storage directory")
+			return
+		}
+	} else {
+		store = NewS3Storage(s3.New(session.Must(session.NewSession())), bucket)
 	}
+	backend := store
 
-	sess := session.Must(session.NewSession())
-	svc := s3.New(sess)
+	if cacheDir := os.Getenv("CACHE_DIR"); cacheDir != "" {
+		cacheSize := int64(defaultCacheSize)
+		if v := os.Getenv("CACHE_SIZE"); v != "" {
+			if cacheSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+				logrus.WithError(err).Fatal("invalid cache size")
+				return
+			}
+		}
+		cache, err := NewCacheStorage(store, cacheDir, cacheSize)
+		if err != nil {
+			logrus.WithError(err).Fatal("invalid cache directory")
+			return
+		}
+		store = cache
+		prometheus.MustRegister(cacheRequests)
+		prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gemserve_storage_cache_size_bytes",
+			Help: "Bytes held by the local storage cache.",
+		}, func() float64 { return float64(cache.Size()) }))
+	}
 
-	idx, err := LoadIndex(s3.New(sess), bucket, DependencyAPIEndpoint)
+	// commands load the index themselves, so that reindex can replace an
+	// index that cannot be loaded
+	if len(os.Args) > 1 {
+		if err := runCommand(newIndex(store, DependencyAPIEndpoint), os.Args[1:]); err != nil {
+			logrus.WithError(err).Fatal(os.Args[1] + " failed")
+		}
+		return
+	}
+
+	idx, err := LoadIndex(store, DependencyAPIEndpoint)
 	if err != nil {
 		logrus.WithError(err).Fatal("failed to load index")
 		return
 	}
 
+	pollInterval := defaultPollInterval
+	if v := os.Getenv("INDEX_POLL_INTERVAL"); v != "" {
+		if pollInterval, err = time.ParseDuration(v); err != nil {
+			logrus.WithError(err).Fatal("invalid index poll interval")
+			return
+		}
+	}
+	maxGemSize := int64(defaultMaxGemSize)
+	if v := os.Getenv("MAX_GEM_SIZE"); v != "" {
+		if maxGemSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			logrus.WithError(err).Fatal("invalid maximum gem size")
+			return
+		}
+	}
+
+	// DOWNLOAD_REDIRECT is either "presign", to redirect downloads to
+	// presigned storage URLs, or the base URL of a CDN serving the storage
+	var redirect redirector
+	switch v := os.Getenv("DOWNLOAD_REDIRECT"); v {
+	case "":
+	case "presign":
+		presigner, ok := backend.(Presigner)
+		if !ok {
+			logrus.Fatal("storage does not support presigned downloads")
+			return
+		}
+		ttl := defaultRedirectTTL
+		if v := os.Getenv("DOWNLOAD_REDIRECT_TTL"); v != "" {
+			if ttl, err = time.ParseDuration(v); err != nil {
+				logrus.WithError(err).Fatal("invalid download redirect ttl")
+				return
+			}
+		}
+		redirect = presignRedirect(presigner, ttl)
+	default:
+		if u, err := url.Parse(v); err != nil || u.Host == "" {
+			logrus.WithField("url", v).Fatal("invalid download redirect url")
+			return
+		}
+		redirect = cdnRedirect(v)
+	}
+
+	go idx.Watch(NewPollSource(pollInterval), nil)
+	go func() {
+		if err := idx.RecoverPushes(stalePushAge); err != nil {
+			logrus.WithError(err).Error("failed to recover abandoned pushes")
+		}
+	}()
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gemserve_index_age_seconds",
+		Help: "Seconds since the in memory index was last known to match the persisted index.",
+	}, func() float64 { return idx.Age().Seconds() }))
+
+	// upstream requests that time out are answered from stored copies
+	upstreamTimeout := defaultUpstreamTimeout
+	if v := os.Getenv("UPSTREAM_TIMEOUT"); v != "" {
+		if upstreamTimeout, err = time.ParseDuration(v); err != nil {
+			logrus.WithError(err).Fatal("invalid upstream timeout")
+			return
+		}
+	}
 	client := http.Client{
-		Transport: httpcache.NewMemoryCacheTransport(),
+		Timeout: upstreamTimeout,
+	}
+	// the timeout of client covers reading the body, which gem downloads
+	// may take longer for, so only their connection and response headers
+	// are bounded
+	gemClient := http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   upstreamTimeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   upstreamTimeout,
+			ResponseHeaderTimeout: upstreamTimeout,
+		},
+	}
+	cache, err := newUpstreamCache(store)
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid upstream cache")
+		return
+	}
+	// UPSTREAMS_CONFIG names a JSON file configuring the upstream sources,
+	// rubygems.org by default
+	up := &upstreamSet{sources: []*upstream{
+		{name: "rubygems", client: client, gemClient: gemClient, base: defaultGemSource, cache: cache},
+	}}
+	if v := os.Getenv("UPSTREAMS_CONFIG"); v != "" {
+		if up, err = loadUpstreams(v, client, gemClient, cache); err != nil {
+			logrus.WithError(err).Fatal("invalid upstreams config")
+			return
+		}
+	}
+	if err := up.Load(); err != nil {
+		logrus.WithError(err).Fatal("failed to load upstream cache")
+		return
 	}
-	http.HandleFunc(DependencyAPIEndpoint, fetchGemDepsHandler(client, idx))
+	// RESERVED_PREFIXES lists, comma separated, the prefixes of gem names
+	// only ever served from private gems, like the names of private gems
+	policy := &namespacePolicy{index: idx, prefixes: splitPrefixes(os.Getenv("RESERVED_PREFIXES"))}
+	for _, u := range up.sources {
+		if _, err := url.Parse(u.base); err != nil {
+			logrus.WithError(err).Fatal("invalid gem source")
+			return
+		}
+	}
+	http.HandleFunc(DependencyAPIEndpoint, fetchGemDepsHandler(up, idx, policy))
 	http.HandleFunc(path.Join("/private", DependencyAPIEndpoint), fetchPrivateGemDepsHandler(idx))
-	http.HandleFunc("/private/api/v1/gems", postGemHandler(svc, bucket, idx))
+	http.HandleFunc("/private/api/v1/gems", postGemHandler(idx, maxGemSize))
+	http.Handle("/private/api/v1/versions/", http.StripPrefix("/private/api/v1/versions/", fetchGemVersionsHandler(idx)))
 	http.HandleFunc("/private/api/v1/gems/yank", func(w http.ResponseWriter, r *http.Request) {
 		body, _ := ioutil.ReadAll(r.Body)
 		r.Body.Close()
 		params, _ := url.ParseQuery(string(body))
-		name, version := params.Get("gem_name"), params.Get("version")
+		md := Metadata{
+			Name:     params.Get("gem_name"),
+			Number:   params.Get("version"),
+			Platform: params.Get("platform"),
+		}
 
-		logrus.WithField("gem", name+"_"+version).Info("deleted gem")
+		logrus.WithField("gem", md.FullName()).Info("yanked gem")
 
-		if err := idx.Delete(name, version); err != nil {
+		if err := idx.Yank(md.Name, md.Number, md.Platform); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -98,9 +262,12 @@ func main() {
 
 	proxy := &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
+			source := up.Proxied(req.URL.Path)
+			gemSource, _ := url.Parse(source.base)
 			req.URL.Scheme = gemSource.Scheme
 			req.URL.Host = gemSource.Host
 			req.Host = gemSource.Host
+			source.authorize(req)
 			if _, ok := req.Header["User-Agent"]; !ok {
 				// explicitly disable User-Agent so it's not set to default value
 				req.Header.Set("User-Agent", "")
@@ -113,9 +280,46 @@ func main() {
 		},
 	}
 
-	http.HandleFunc("/gems/", fetchGemHandler(svc, bucket, proxy.ServeHTTP))
-	http.HandleFunc("/private/versions", http.NotFound)
-	http.Handle("/private/gems/", http.StripPrefix("/private/", fetchGemHandler(svc, bucket, nil)))
+	// gems not pushed to gemserve are downloaded from their upstream source,
+	// and kept in storage with ENABLE_PULL_THROUGH
+	pull := &pullThrough{
+		redirect:  redirect,
+		upstreams: up,
+		policy:    policy,
+		fallback:  proxy.ServeHTTP,
+	}
+	if os.Getenv("ENABLE_PULL_THROUGH") != "" {
+		pull.store = store
+
+		// UPSTREAM_RETENTION bounds how long upstream gems are kept after
+		// they are stored, however often they are downloaded. They are kept
+		// forever by default.
+		if v := os.Getenv("UPSTREAM_RETENTION"); v != "" {
+			retention, err := time.ParseDuration(v)
+			if err != nil {
+				logrus.WithError(err).Fatal("invalid upstream retention")
+				return
+			}
+			go func() {
+				for range time.Tick(upstreamJanitorInterval) {
+					if err := pull.Expire(retention); err != nil {
+						logrus.WithError(err).Error("failed to expire upstream gems")
+					}
+				}
+			}()
+		}
+	}
+	http.HandleFunc("/gems/", fetchGemHandler(store, redirect, pull.ServeHTTP))
+	http.HandleFunc("/versions", fetchMergedVersionsHandler(up, idx, policy))
+	http.Handle("/info/", http.StripPrefix("/info/", fetchMergedInfoHandler(up, idx, policy)))
+	http.HandleFunc("/private/versions", fetchVersionsHandler(idx))
+	http.HandleFunc("/private/names", fetchNamesHandler(idx))
+	http.Handle("/private/info/", http.StripPrefix("/private/info/", fetchInfoHandler(idx)))
+	for _, file := range []string{specsFile, latestSpecsFile, prereleaseSpecsFile} {
+		http.HandleFunc("/private/"+file, fetchSpecsHandler(idx))
+	}
+	http.Handle("/private/gems/", http.StripPrefix("/private/", fetchGemHandler(store, redirect, nil)))
+	http.Handle("/private/quick/", http.StripPrefix("/private/", fetchGemHandler(store, nil, nil)))
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if enableProxy == "" {
 			http.NotFound(w, r)
@@ -133,6 +337,17 @@ func main() {
 		mux.Handle("/metrics", promhttp.Handler())
 		logrus.Fatal(http.ListenAndServe(":"+metricsPort, mux))
 	}()
+	// the admin endpoints are only served on ADMIN_PORT, which is kept off
+	// the public network
+	if adminPort := os.Getenv("ADMIN_PORT"); adminPort != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/admin/reindex", reindexHandler(idx))
+			mux.HandleFunc("/admin/fsck", fsckHandler(idx))
+			mux.HandleFunc("/admin/upstream-cache", purgeUpstreamCacheHandler(cache))
+			logrus.Fatal(http.ListenAndServe(":"+adminPort, loggingHandler{os.Stdout, mux}))
+		}()
+	}
 	logrus.Fatal(http.ListenAndServe(":"+serverPort, loggingHandler{os.Stdout, http.DefaultServeMux}))
 }
 
@@ -160,7 +375,11 @@ func (h loggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 func fetchPrivateGemDepsHandler(index *Index) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		gems := strings.Split(req.URL.Query().Get("gems"), ",")
+		gems, err := requestedGems(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
 		if err := writeDeps(w, index.Lookup(gems...)); err != nil {
 			logrus.Error(err)
 			http.Error(w, "", http.StatusInternalServerError)
@@ -168,43 +387,172 @@ func fetchPrivateGemDepsHandler(index *Index) http.HandlerFunc {
 	}
 }
 
-func fetchGemHandler(svc *s3.S3, bucket string, notFound http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		res, err := svc.GetObject(&s3.GetObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(r.URL.Path),
-		})
-		if err != nil {
-			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
-				if notFound == nil {
-					notFound = http.NotFound
-				}
-				notFound(w, r)
+// gemVersion is an entry of the RubyGems versions API.
+type gemVersion struct {
+	Number          string            `json:"number"`
+	Platform        string            `json:"platform"`
+	Prerelease      bool              `json:"prerelease"`
+	Summary         string            `json:"summary,omitempty"`
+	Description     string            `json:"description,omitempty"`
+	Authors         string            `json:"authors,omitempty"`
+	Licenses        []string          `json:"licenses,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	SHA             string            `json:"sha,omitempty"`
+	RubyVersion     string            `json:"ruby_version,omitempty"`
+	RubygemsVersion string            `json:"rubygems_version,omitempty"`
+}
+
+// fetchGemVersionsHandler serves the versions of a private gem with the
+// details recorded from its specification. The path is expected to be
+// the remaining <name>.json, optionally filtered by a requirement query,
+// or <name>/latest.json for the latest release.
+func fetchGemVersionsHandler(index *Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		name := strings.TrimSuffix(req.URL.Path, ".json")
+		if strings.HasSuffix(name, "/latest") {
+			fetchLatestVersion(w, req, index, strings.TrimSuffix(name, "/latest"))
+			return
+		}
+		deps := index.Lookup(name)
+		if r := req.URL.Query().Get("requirement"); r != "" {
+			requirement, err := gemver.ParseRequirement(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
+			deps = index.Satisfying(name, requirement)
+		}
+		if len(deps) == 0 {
+			http.NotFound(w, req)
+			return
+		}
+		versions := make([]gemVersion, len(deps))
+		for i, md := range deps {
+			v := gemVersion{
+				Number:     md.Number,
+				Platform:   md.Platform,
+				Prerelease: md.Prerelease(),
+				SHA:        md.Checksum,
+			}
+			if spec := md.Spec; spec != nil {
+				v.Summary = spec.Summary
+				v.Description = spec.Description
+				v.Authors = strings.Join(spec.Authors, ", ")
+				v.Licenses = spec.Licenses
+				v.Metadata = spec.Metadata
+				v.RubyVersion = strings.Join(spec.RequiredRubyVersion.Strings(), ", ")
+				v.RubygemsVersion = strings.Join(spec.RequiredRubygemsVersion.Strings(), ", ")
+			}
+			versions[i] = v
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(versions); err != nil {
 			logrus.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// fetchLatestVersion writes the latest release of the named gem as in
+// the RubyGems /api/v1/versions/<name>/latest.json endpoint.
+func fetchLatestVersion(w http.ResponseWriter, req *http.Request, index *Index, name string) {
+	version := "unknown"
+	if md := index.Latest(name); md != nil {
+		version = md.Number
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]string{"version": version}); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// newUpstreamCache configures the upstream metadata cache from the
+// environment. Files are kept in store unless UPSTREAM_CACHE_DIR names a
+// local directory for them.
+func newUpstreamCache(store Storage) (*metadataCache, error) {
+	var (
+		ttl     = defaultUpstreamCacheTTL
+		swr     = defaultUpstreamCacheSWR
+		maxSize = int64(defaultUpstreamCacheMax)
+		err     error
+	)
+	if dir := os.Getenv("UPSTREAM_CACHE_DIR"); dir != "" {
+		if store, err = NewFileStorage(dir); err != nil {
+			return nil, err
+		}
+	}
+	if v := os.Getenv("UPSTREAM_CACHE_TTL"); v != "" {
+		if ttl, err = time.ParseDuration(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := os.Getenv("UPSTREAM_CACHE_STALE"); v != "" {
+		if swr, err = time.ParseDuration(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := os.Getenv("UPSTREAM_CACHE_SIZE"); v != "" {
+		if maxSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return newMetadataCache(store, ttl, swr, maxSize), nil
+}
+
+// fetchGemHandler serves stored objects, or redirects to them when redirect
+// is set.
+func fetchGemHandler(store Storage, redirect redirector, notFound http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "", http.StatusMethodNotAllowed)
 			return
 		}
-		io.Copy(w, res.Body)
-		res.Body.Close()
+		err := serveStored(w, r, store, strings.TrimPrefix(r.URL.Path, "/"), redirect)
+		if err == ErrObjectNotFound {
+			if notFound == nil {
+				notFound = http.NotFound
+			}
+			notFound(w, r)
+			return
+		}
+		if err != nil {
+			logrus.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 	}
 }
 
-func fetchGemDepsHandler(client http.Client, idx *Index) http.HandlerFunc {
+// fetchGemDepsHandler serves the dependencies of the requested gems, from
+// the private gems or their upstream sources. Upstream gems in the private
+// namespace are not requested.
+func fetchGemDepsHandler(up *upstreamSet, idx *Index, policy *namespacePolicy) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		base := path.Join(defaultGemSource, "/api/v1/dependencies.json?")
-		res, err := client.Get(base + r.URL.Query().Encode())
+		names, err := requestedGems(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		// private gems are never looked up upstream
+		var public, private []string
+		for _, name := range names {
+			if policy.Private(name) {
+				private = append(private, name)
+				continue
+			}
+			public = append(public, name)
+		}
+
+		vs, stale, err := up.Deps(public...)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			logrus.Error(err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
 			return
 		}
 
-		var vs []Metadata
-		body, _ := ioutil.ReadAll(res.Body)
-		res.Body.Close()
-		json.Unmarshal(body, &vs)
-		vs = append(vs, idx.Deps()...)
+		vs, _ = dedupeMetadata(append(vs, idx.Lookup(private...)...))
+		if stale {
+			w.Header().Set("Warning", staleWarning)
+		}
 		if err := writeDeps(w, vs); err != nil {
 			logrus.Error(err)
 			http.Error(w, "", http.StatusInternalServerError)
@@ -212,48 +560,79 @@ func fetchGemDepsHandler(client http.Client, idx *Index) http.HandlerFunc {
 	}
 }
 
-func postGemHandler(svc *s3.S3, bucket string, idx *Index) http.HandlerFunc {
+// requestedGems returns the distinct gem names of a dependency API request.
+// ErrTooManyGems is returned for more than maxDepsGems names, and
+// ErrInvalidGemName for names that no gem can have.
+func requestedGems(r *http.Request) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(r.URL.Query().Get("gems"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || stringInSlice(name, names) {
+			continue
+		}
+		if !gemNamePattern.MatchString(name) {
+			return nil, ErrInvalidGemName
+		}
+		if len(names) == maxDepsGems {
+			return nil, ErrTooManyGems
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// postGemHandler accepts pushed gems of up to maxSize bytes. Uploads are
+// spooled to a temporary file rather than held in memory.
+func postGemHandler(idx *Index, maxSize int64) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		if req.Method == http.MethodPost {
 			defer req.Body.Close()
-			body, err := ioutil.ReadAll(req.Body)
+			spool, err := ioutil.TempFile("", "gemserve-push-")
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
+				logrus.WithError(err).Error("failed to create spool file")
+				http.Error(w, "", http.StatusInternalServerError)
 				return
 			}
+			defer os.Remove(spool.Name())
+			defer spool.Close()
 
-			if req.ContentLength > 0 && req.ContentLength > int64(len(body)) {
-				http.Error(w, "body: short read", http.StatusInternalServerError)
+			size, err := io.Copy(spool, http.MaxBytesReader(w, req.Body, maxSize))
+			if tooLarge := (*http.MaxBytesError)(nil); errors.As(err, &tooLarge) {
+				http.Error(w, fmt.Sprintf("gem exceeds the maximum size of %d bytes", maxSize), http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if _, err := spool.Seek(0, io.SeekStart); err != nil {
+				http.Error(w, "", http.StatusInternalServerError)
 				return
 			}
-			logrus.Info(req.ContentLength, len(body))
-			gem, err := LoadGem(body)
+			gem, err := LoadGem(spool)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 
-			if err = idx.Put(gem.Metadata); err != nil {
+			result, err := idx.Push(gem, spool)
+			if err == ErrDuplicateGem {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-			key := fmt.Sprintf("gems/%s-%s.gem", gem.Name, gem.Number)
-			result, err := svc.PutObject(&s3.PutObjectInput{
-				Bucket: aws.String(bucket),
-				Key:    aws.String(key),
-				Body:   bytes.NewReader(body),
-			})
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
+				logrus.WithError(err).Error("push failed")
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 
 			logrus.WithFields(logrus.Fields{
 				"name":          gem.Name,
 				"version":       gem.Number,
-				"etag":          *result.ETag,
-				"objectVersion": *result.VersionId,
-				"size":          len(body),
+				"platform":      gem.Platform,
+				"etag":          result.ETag,
+				"objectVersion": result.Version,
+				"size":          size,
 			}).Info("uploaded")
 			w.WriteHeader(http.StatusCreated)
 			return
@@ -276,7 +655,7 @@ func writeDeps(w io.Writer, deps []Metadata) error {
 		g.EndIVar()
 		g.Symbol("platform")
 		g.StartIVar(0)
-		g.String(v.Platform)
+		g.String(normalizePlatform(v.Platform))
 		g.EndIVar()
 		g.Symbol("dependencies")
 		g.StartArray(len(v.Dependencies))
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchGemDepsHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStorage(dir)
+	idx, _ := LoadIndex(store, DependencyAPIEndpoint)
+	idx.Put(Metadata{Name: "foo", Number: "1.0.0", Platform: "ruby"})
+	idx.Put(Metadata{Name: "unrequested", Number: "1.0.0", Platform: "ruby"})
+
+	status := http.StatusOK
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/info/rack" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte("---\n2.0.0 |checksum:abc\n"))
+	}))
+	defer source.Close()
+	up := &upstreamSet{sources: []*upstream{{base: source.URL}}}
+	handler := fetchGemDepsHandler(up, idx, &namespacePolicy{index: idx})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/api/v1/dependencies?gems=foo,rack,rack,missing", nil))
+	body := w.Body.String()
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200; got %d %q", w.Code, body)
+	}
+	if strings.Count(body, "foo") != 1 || strings.Count(body, "rack") != 1 {
+		t.Errorf("expected foo and rack once; got %q", body)
+	}
+	if strings.Contains(body, "unrequested") {
+		t.Errorf("expected only requested gems; got %q", body)
+	}
+
+	w = httptest.NewRecorder()
+	gems := make([]string, maxDepsGems+1)
+	for n := range gems {
+		gems[n] = fmt.Sprintf("gem%d", n)
+	}
+	handler(w, httptest.NewRequest("GET", "/api/v1/dependencies?gems="+strings.Join(gems, ","), nil))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for too many gems; got %d", w.Code)
+	}
+
+	status = http.StatusInternalServerError
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/api/v1/dependencies?gems=rack", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected 502 for upstream failure; got %d", w.Code)
+	}
+}
+
+func TestUpstreamPathTraversal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStorage(dir)
+	idx, _ := LoadIndex(store, DependencyAPIEndpoint)
+	idx.Put(Metadata{Name: "foo", Number: "1.0.0", Platform: "ruby"})
+
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("---\n"))
+	}))
+	defer source.Close()
+	cache := newMetadataCache(store, time.Hour, 0, 1<<20)
+	up := &upstreamSet{sources: []*upstream{{name: "rubygems", base: source.URL, cache: cache}}}
+	policy := &namespacePolicy{index: idx}
+
+	name := "../../../api/v1/dependencies.json"
+	w := httptest.NewRecorder()
+	fetchGemDepsHandler(up, idx, policy)(w, httptest.NewRequest("GET", "/api/v1/dependencies?gems="+name, nil))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for invalid gem name; got %d", w.Code)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.URL.Path = name
+	w = httptest.NewRecorder()
+	fetchMergedInfoHandler(up, idx, policy)(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid gem name; got %d", w.Code)
+	}
+	if _, _, err := cache.Get("/rubygems/info/..", func() ([]byte, error) { return []byte("---\n"), nil }); err == nil {
+		t.Error("expected path with dot segments to be refused")
+	}
+
+	reloaded, err := LoadIndex(store, DependencyAPIEndpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deps := reloaded.Lookup("foo"); len(deps) != 1 {
+		t.Errorf("expected index to be left untouched; got %v", deps)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// metadataCache keeps upstream metadata files, such as the compact index,
+// in a Storage so they are shared between replicas and survive restarts.
+// A file is served from the cache for ttl after it was fetched and, while
+// it is refetched in the background, for swr after that. Concurrent
+// fetches of a file are coalesced into one upstream request, and the least
+// recently used files are evicted once the cache exceeds maxSize bytes.
+type metadataCache struct {
+	store   Storage
+	ttl     time.Duration
+	swr     time.Duration
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	// lru orders the entries from most to least recently used
+	lru     *list.List
+	flights map[string]*flight
+}
+
+type metadataEntry struct {
+	path    string
+	size    int64
+	fetched time.Time
+}
+
+// flight is a fetch in progress, which concurrent requests wait for.
+type flight struct {
+	done chan struct{}
+	body []byte
+	err  error
+}
+
+func newMetadataCache(store Storage, ttl, swr time.Duration, maxSize int64) *metadataCache {
+	return &metadataCache{
+		store:   store,
+		ttl:     ttl,
+		swr:     swr,
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		flights: make(map[string]*flight),
+	}
+}
+
+// key returns the storage key of the file at path. Paths with dot segments
+// are refused, as their keys could lie outside the cache.
+func (c *metadataCache) key(path string) (string, error) {
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "." || segment == ".." {
+			return "", fmt.Errorf("invalid upstream path %q", path)
+		}
+	}
+	return upstreamPrefix + strings.TrimPrefix(path, "/"), nil
+}
+
+// Load adds the files already stored below the paths to the cache.
+func (c *metadataCache) Load(paths ...string) error {
+	for _, path := range paths {
+		key, err := c.key(path)
+		if err != nil {
+			return err
+		}
+		objects, err := c.store.List(key)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		for _, obj := range objects {
+			c.add("/"+strings.TrimPrefix(obj.Key, upstreamPrefix), obj.Size, obj.LastModified)
+		}
+		c.mu.Unlock()
+	}
+	c.evict()
+	return nil
+}
+
+// Get returns the file at path, calling fetch if it is not cached or has
+// expired. When fetch fails with anything but ErrUpstreamNotFound, an
+// expired copy is returned instead and reported as stale.
+func (c *metadataCache) Get(path string, fetch func() ([]byte, error)) (body []byte, stale bool, err error) {
+	key, err := c.key(path)
+	if err != nil {
+		return nil, false, err
+	}
+	c.mu.Lock()
+	el, cached := c.entries[path]
+	c.mu.Unlock()
+	if !cached {
+		// another replica may have cached the file
+		if info, err := c.store.Stat(key); err == nil {
+			c.mu.Lock()
+			c.add(path, info.Size, info.LastModified)
+			c.mu.Unlock()
+			c.evict()
+		}
+	}
+
+	var age time.Duration
+	c.mu.Lock()
+	if el, cached = c.entries[path]; cached {
+		c.lru.MoveToFront(el)
+		age = time.Since(el.Value.(*metadataEntry).fetched)
+	}
+	c.mu.Unlock()
+
+	if cached && age < c.ttl+c.swr {
+		body, err := c.read(path)
+		if err == nil {
+			if age >= c.ttl {
+				go func() {
+					if _, err := c.refresh(path, fetch); err != nil && err != ErrUpstreamNotFound {
+						logrus.WithError(err).WithField("path", path).Warn("failed to revalidate upstream file")
+					}
+				}()
+			}
+			return body, false, nil
+		}
+		logrus.WithError(err).WithField("path", path).Warn("failed to read cached upstream file")
+	}
+
+	body, err = c.refresh(path, fetch)
+	if err == nil || err == ErrUpstreamNotFound || !cached {
+		return body, false, err
+	}
+	body, rerr := c.read(path)
+	if rerr != nil {
+		return nil, false, err
+	}
+	logrus.WithError(err).WithField("path", path).Warn("upstream unavailable, serving stale copy")
+	return body, true, nil
+}
+
+func (c *metadataCache) read(path string) ([]byte, error) {
+	key, err := c.key(path)
+	if err != nil {
+		return nil, err
+	}
+	rc, _, err := c.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// refresh fetches path and caches the result, unless a fetch of path is
+// already in progress, in which case its result is shared.
+func (c *metadataCache) refresh(path string, fetch func() ([]byte, error)) ([]byte, error) {
+	c.mu.Lock()
+	if f, ok := c.flights[path]; ok {
+		c.mu.Unlock()
+		<-f.done
+		return f.body, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	c.flights[path] = f
+	c.mu.Unlock()
+
+	f.body, f.err = fetch()
+	if f.err == nil {
+		c.put(path, f.body)
+	}
+	c.mu.Lock()
+	delete(c.flights, path)
+	c.mu.Unlock()
+	close(f.done)
+	return f.body, f.err
+}
+
+func (c *metadataCache) put(path string, body []byte) {
+	if int64(len(body)) > c.maxSize {
+		return
+	}
+	key, err := c.key(path)
+	if err == nil {
+		_, err = c.store.Put(key, bytes.NewReader(body), "")
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("path", path).Error("failed to cache upstream file")
+		return
+	}
+	c.mu.Lock()
+	c.add(path, int64(len(body)), time.Now())
+	c.mu.Unlock()
+	c.evict()
+}
+
+// add records a cached file. c.mu must be held.
+func (c *metadataCache) add(path string, size int64, fetched time.Time) {
+	if el, ok := c.entries[path]; ok {
+		c.size -= c.lru.Remove(el).(*metadataEntry).size
+	}
+	c.entries[path] = c.lru.PushFront(&metadataEntry{path: path, size: size, fetched: fetched})
+	c.size += size
+}
+
+// evict removes the least recently used files until the cache fits.
+func (c *metadataCache) evict() {
+	var evicted []string
+	c.mu.Lock()
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		entry := c.lru.Remove(c.lru.Back()).(*metadataEntry)
+		delete(c.entries, entry.path)
+		c.size -= entry.size
+		evicted = append(evicted, entry.path)
+	}
+	c.mu.Unlock()
+	c.delete(evicted)
+}
+
+// Purge removes the file at path from the cache, or every file if path is
+// empty. It returns the paths removed.
+func (c *metadataCache) Purge(path string) []string {
+	var purged []string
+	c.mu.Lock()
+	for p, el := range c.entries {
+		if path != "" && p != path {
+			continue
+		}
+		c.size -= c.lru.Remove(el).(*metadataEntry).size
+		delete(c.entries, p)
+		purged = append(purged, p)
+	}
+	c.mu.Unlock()
+	c.delete(purged)
+	return purged
+}
+
+func (c *metadataCache) delete(paths []string) {
+	for _, path := range paths {
+		key, err := c.key(path)
+		if err == nil {
+			err = c.store.Delete(key)
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("path", path).Error("failed to remove cached upstream file")
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMetadataCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStorage(dir)
+	cache := newMetadataCache(store, time.Hour, 0, 10)
+
+	var fetches int32
+	fetch := func(body string) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			atomic.AddInt32(&fetches, 1)
+			time.Sleep(10 * time.Millisecond)
+			return []byte(body), nil
+		}
+	}
+
+	// concurrent requests share one fetch
+	var wg sync.WaitGroup
+	for n := 0; n < 10; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if body, _, err := cache.Get("/info/a", fetch("aaaa")); err != nil || string(body) != "aaaa" {
+				t.Errorf("expected fetched file; got %q, %v", body, err)
+			}
+		}()
+	}
+	wg.Wait()
+	// fresh files are served from the cache
+	cache.Get("/info/a", fetch("AAAA"))
+	if fetches != 1 {
+		t.Errorf("expected a single fetch; got %d", fetches)
+	}
+
+	// a restarted replica finds the cached file in storage
+	restarted := newMetadataCache(store, time.Hour, 0, 10)
+	if err := restarted.Load("/info/"); err != nil {
+		t.Fatal(err)
+	}
+	if body, _, _ := restarted.Get("/info/a", fetch("AAAA")); string(body) != "aaaa" {
+		t.Errorf("expected file cached before restart; got %q", body)
+	}
+
+	cache.Get("/info/b", fetch("bbbbbbbb"))
+	if _, err := store.Stat(upstreamPrefix + "info/a"); err != ErrObjectNotFound {
+		t.Errorf("expected least recently used file to be evicted; got %v", err)
+	}
+	if purged := cache.Purge("/info/b"); len(purged) != 1 {
+		t.Errorf("expected purged file; got %v", purged)
+	}
+	if _, err := store.Stat(upstreamPrefix + "info/b"); err != ErrObjectNotFound {
+		t.Errorf("expected purged file to be removed; got %v", err)
+	}
+}
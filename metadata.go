@@ -2,54 +2,115 @@ package main
 
 import (
 	"fmt"
+	"regexp"
+	"strings"
 
-	yaml "gopkg.in/yaml.v2"
+	"github.com/mattaitchison/gemserve/gemver"
 )
 
+var gemNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// platformPattern restricts platforms, which are part of the storage keys
+// of a gem, to the characters of platforms like x86_64-linux.
+var platformPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// UnmarshalMetadata decodes and validates the YAML specification from metadata.gz.
+// Every requirement clause of a runtime dependency is kept, joined by ", "
+// as the dependency API expects.
 func UnmarshalMetadata(b []byte) (Metadata, error) {
-	var m metadata
-	if err := yaml.Unmarshal(b, &m); err != nil {
+	spec, err := UnmarshalSpecification(b)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("invalid gemspec: %s", err)
+	}
+	if err := spec.Validate(); err != nil {
 		return Metadata{}, err
 	}
 	var deps [][]string
-	for _, dep := range m.Dependencies {
-		if dep.Type != ":runtime" {
+	for _, dep := range spec.Dependencies {
+		if dependencyType(dep.Type) != "runtime" {
 			continue
 		}
-
 		deps = append(deps, []string{
 			dep.Name,
-			fmt.Sprintf("%s %s",
-				dep.Requirement.Requirements[0][0],
-				dep.Requirement.Requirements[0][1].(map[interface{}]interface{})["version"]),
+			strings.Join(dep.Requirement.Strings(), ", "),
 		})
 	}
 	return Metadata{
-		Name:         m.Name,
-		Number:       m.Version.Version,
-		Platform:     m.Platform,
+		Name:         spec.Name,
+		Number:       spec.Version.Version,
+		Platform:     spec.Platform,
 		Dependencies: deps,
+		Spec:         spec,
 	}, nil
 }
 
+// Validate reports the first problem that would prevent the spec from being
+// served to RubyGems or Bundler.
+func (s *Specification) Validate() error {
+	if !gemNamePattern.MatchString(s.Name) {
+		return fmt.Errorf("invalid gemspec: invalid name %q", s.Name)
+	}
+	if s.Version.Version == "" || !gemver.Valid(s.Version.Version) {
+		return fmt.Errorf("invalid gemspec: invalid version %q", s.Version.Version)
+	}
+	if s.Platform != "" && !platformPattern.MatchString(s.Platform) {
+		return fmt.Errorf("invalid gemspec: invalid platform %q", s.Platform)
+	}
+	for _, dep := range s.Dependencies {
+		if !gemNamePattern.MatchString(dep.Name) {
+			return fmt.Errorf("invalid gemspec: invalid dependency name %q", dep.Name)
+		}
+		if err := dep.Requirement.validate(); err != nil {
+			return fmt.Errorf("invalid gemspec: dependency %s: %s", dep.Name, err)
+		}
+	}
+	if err := s.RequiredRubyVersion.validate(); err != nil {
+		return fmt.Errorf("invalid gemspec: required_ruby_version: %s", err)
+	}
+	if err := s.RequiredRubygemsVersion.validate(); err != nil {
+		return fmt.Errorf("invalid gemspec: required_rubygems_version: %s", err)
+	}
+	return nil
+}
+
+func (r Requirement) validate() error {
+	for _, c := range r.Requirements {
+		if _, err := gemver.ParseConstraint(c.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FullName returns the name-version identity of the gem, suffixed with the
+// platform for platform specific gems as in nokogiri-1.8.0-x86_64-linux.
+func (md Metadata) FullName() string {
+	if platform := normalizePlatform(md.Platform); platform != "ruby" {
+		return md.Name + "-" + md.Number + "-" + platform
+	}
+	return md.Name + "-" + md.Number
+}
+
+// Prerelease reports whether the version is a prerelease as RubyGems reads
+// it, as in 1.0.0.rc1 or 1.0-1. Malformed versions are not prereleases.
+func (md Metadata) Prerelease() bool {
+	v, err := gemver.Parse(md.Number)
+	return err == nil && v.Prerelease()
+}
+
+// normalizePlatform returns platform, defaulting to the pure ruby platform.
+func normalizePlatform(platform string) string {
+	if platform == "" {
+		return "ruby"
+	}
+	return platform
+}
+
 type Metadata struct {
 	Name         string
 	Number       string
 	Platform     string
 	Dependencies [][]string
-}
-
-type metadata struct {
-	Name    string
-	Version struct {
-		Version string
-	}
-	Platform     string
-	Dependencies []struct {
-		Name        string
-		Type        string
-		Requirement struct {
-			Requirements [][]interface{}
-		}
-	}
+	Checksum     string         `json:",omitempty"`
+	Spec         *Specification `json:",omitempty"`
 }
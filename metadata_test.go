@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"io/ioutil"
 	"testing"
 )
@@ -60,3 +61,48 @@ func TestDecodeMetadata(t *testing.T) {
 
 	}
 }
+
+func TestDecodeMetadataRequirements(t *testing.T) {
+	buf, _ := ioutil.ReadFile("testdata/rails-plugin-metadata.yaml")
+	v, err := UnmarshalMetadata(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Dependencies) != 1 {
+		t.Fatalf("expected only runtime deps; got %q", v.Dependencies)
+	}
+	if dep := v.Dependencies[0]; dep[0] != "rails" || dep[1] != ">= 6.0, < 8" {
+		t.Errorf("invalid dep; got: %q expected %q", dep, []string{"rails", ">= 6.0, < 8"})
+	}
+}
+
+func TestDecodeMetadataInvalid(t *testing.T) {
+	buf, _ := ioutil.ReadFile("testdata/rails-plugin-metadata.yaml")
+	for _, tt := range []struct{ old, new string }{
+		{`"<"`, `"=<"`},
+		{`version: '8'`, `version:`},
+		{`version: '8'`, `version: [8]`},
+		{`- - "<"`, `- "<"`},
+		{`name: rails-plugin`, `name: rails plugin`},
+		{`platform: ruby`, `platform: x/../../../quick/Marshal.4.8/victim-1.0`},
+	} {
+		invalid := bytes.Replace(buf, []byte(tt.old), []byte(tt.new), 1)
+		if _, err := UnmarshalMetadata(invalid); err == nil {
+			t.Errorf("expected error replacing %q with %q", tt.old, tt.new)
+		}
+	}
+}
+
+func TestFullName(t *testing.T) {
+	tests := map[string]Metadata{
+		"sinatra-2.0.0":               {Name: "sinatra", Number: "2.0.0", Platform: "ruby"},
+		"rack-2.0.1":                  {Name: "rack", Number: "2.0.1"},
+		"nokogiri-1.8.0-x86_64-linux": {Name: "nokogiri", Number: "1.8.0", Platform: "x86_64-linux"},
+		"nokogiri-1.8.0-arm64-darwin": {Name: "nokogiri", Number: "1.8.0", Platform: "arm64-darwin"},
+	}
+	for expected, md := range tests {
+		if got := md.FullName(); got != expected {
+			t.Errorf("invalid full name; got: %q expected %q", got, expected)
+		}
+	}
+}
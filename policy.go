@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// namespacePolicy protects private gems against dependency confusion. Gem
+// names in index, or starting with a reserved prefix, belong to the
+// private namespace and are only ever served from private gems; upstream
+// gems with those names are ignored on the merged endpoints.
+type namespacePolicy struct {
+	index    *Index
+	prefixes []string
+}
+
+// splitPrefixes returns the prefixes of a comma separated list. Blank
+// entries are dropped, as the empty prefix would reserve every name.
+func splitPrefixes(list string) []string {
+	var prefixes []string
+	for _, prefix := range strings.Split(list, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// Reserved reports whether name starts with a reserved prefix.
+func (p *namespacePolicy) Reserved(name string) bool {
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Private reports whether name belongs to the private namespace.
+func (p *namespacePolicy) Private(name string) bool {
+	return p.Reserved(name) || len(p.index.Lookup(name)) > 0
+}
+
+// Filter is like Private for checking many names against the index as it
+// is now.
+func (p *namespacePolicy) Filter() func(name string) bool {
+	names := make(map[string]bool)
+	for _, md := range p.index.Deps() {
+		names[md.Name] = true
+	}
+	return func(name string) bool {
+		return names[name] || p.Reserved(name)
+	}
+}
+
+// shadowedLogged holds the names of the shadowed gems already logged.
+var shadowedLogged sync.Map
+
+// logShadowed records upstream gems ignored because they share a name with
+// private gems, once per name as upstream lists them on every request.
+func logShadowed(names ...string) {
+	var unlogged []string
+	for _, name := range names {
+		if _, logged := shadowedLogged.LoadOrStore(name, true); !logged {
+			unlogged = append(unlogged, name)
+		}
+	}
+	if len(unlogged) > 0 {
+		logrus.WithField("gems", unlogged).Warn("ignoring upstream gems in the private namespace")
+	}
+}
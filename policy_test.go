@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNamespacePolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStorage(dir)
+	idx, _ := LoadIndex(store, DependencyAPIEndpoint)
+	idx.Put(Metadata{Name: "foo", Number: "1.0.0", Platform: "ruby", Checksum: "abc"})
+	policy := &namespacePolicy{index: idx, prefixes: []string{"acme-"}}
+
+	requested := make(map[string]bool)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested[r.URL.Path] = true
+		switch r.URL.Path {
+		case "/versions":
+			w.Write([]byte("created_at: 2017-01-01T00:00:00Z\n---\nacme-bar 9.9.9 aaa\nfoo 9.9.9 bbb\nrack 2.0.0 ccc\n"))
+		case "/info/foo", "/info/rack":
+			w.Write([]byte("---\n9.9.9 |checksum:evil\n"))
+		default:
+			if strings.HasPrefix(r.URL.Path, "/gems/") {
+				w.Write([]byte("evil"))
+				return
+			}
+			http.NotFound(w, r)
+		}
+	}))
+	defer source.Close()
+	up := &upstreamSet{sources: []*upstream{{base: source.URL}}}
+
+	w := httptest.NewRecorder()
+	fetchMergedVersionsHandler(up, idx, policy)(w, httptest.NewRequest("GET", "/versions", nil))
+	body := w.Body.String()
+	if strings.Contains(body, "acme-bar") || strings.Contains(body, "foo 9.9.9") {
+		t.Errorf("expected upstream private gems to be dropped; got %q", body)
+	}
+	if !strings.Contains(body, "rack 2.0.0") || !strings.Contains(body, "\nfoo 1.0.0 ") {
+		t.Errorf("expected public and private gems to be listed; got %q", body)
+	}
+
+	// the info handler is mounted below /info/
+	req := httptest.NewRequest("GET", "/info/foo", nil)
+	req.URL.Path = "foo"
+	w = httptest.NewRecorder()
+	fetchMergedInfoHandler(up, idx, policy)(w, req)
+	if body := w.Body.String(); strings.Contains(body, "evil") || !strings.Contains(body, "1.0.0") {
+		t.Errorf("expected private info only; got %q", body)
+	}
+	if requested["/info/foo"] {
+		t.Error("expected private gem not to be requested upstream")
+	}
+
+	pull := &pullThrough{upstreams: up, policy: policy}
+	for _, path := range []string{"/gems/foo-9.9.9.gem", "/gems/foo-1.0.0-x86_64-darwin-19.gem", "/gems/acme-bar-9.9.9.gem"} {
+		w = httptest.NewRecorder()
+		pull.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404; got %d", path, w.Code)
+		}
+	}
+}
+
+func TestSplitPrefixes(t *testing.T) {
+	tests := map[string][]string{
+		"":             nil,
+		"acme-,":       {"acme-"},
+		"acme-, corp-": {"acme-", "corp-"},
+		" , ,acme-":    {"acme-"},
+	}
+	for list, expected := range tests {
+		if prefixes := splitPrefixes(list); !reflect.DeepEqual(prefixes, expected) {
+			t.Errorf("%q: expected %q; got %q", list, expected, prefixes)
+		}
+	}
+	policy := &namespacePolicy{prefixes: splitPrefixes("acme-,")}
+	if policy.Reserved("rack") {
+		t.Error("expected a trailing comma not to reserve every name")
+	}
+}
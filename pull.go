@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// upstreamPrefix holds copies of upstream gems, kept apart from the gems
+// pushed to gemserve.
+const upstreamPrefix = "upstream/"
+
+// gemFilePattern splits a gem file name into the gem name and the rest. The
+// name ends before the first segment starting with a digit, as platforms
+// like x86_64-darwin-19 contain dashes and digits too.
+var gemFilePattern = regexp.MustCompile(`^(.+?)-\d[^-]*(-.+)?\.gem$`)
+
+// pullThrough serves gem downloads from the upstream sources of the gem.
+// When store is set, upstream gems are served from it and copied to it on
+// their first download.
+type pullThrough struct {
+	store     Storage
+	redirect  redirector
+	upstreams *upstreamSet
+	// policy, when set, keeps gems in the private namespace from being
+	// downloaded from upstream
+	policy *namespacePolicy
+	// fallback handles requests for anything but gem files
+	fallback http.HandlerFunc
+}
+
+func (p *pullThrough) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isGemPath(r.URL.Path) {
+		p.fallback(w, r)
+		return
+	}
+	if name := gemFilePattern.FindStringSubmatch(path.Base(r.URL.Path))[1]; p.policy != nil && p.policy.Private(name) {
+		http.NotFound(w, r)
+		return
+	}
+	key := upstreamPrefix + strings.TrimPrefix(r.URL.Path, "/")
+	if p.store != nil {
+		err := serveStored(w, r, p.store, key, p.redirect)
+		if err == nil {
+			return
+		}
+		if err != ErrObjectNotFound {
+			logrus.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := p.pull(w, r, key); err != nil {
+		logrus.WithError(err).WithField("path", r.URL.Path).Error("failed to pull upstream gem")
+	}
+}
+
+// isGemPath reports whether p names a gem file, /gems/<full name>.gem.
+func isGemPath(p string) bool {
+	return path.Clean(p) == p && path.Dir(p) == "/gems" && gemFilePattern.MatchString(path.Base(p))
+}
+
+// pull streams the gem from the first of its sources that has it, trying
+// the next source when one does not know the gem or fails. A
+// complete download is spooled and then stored at key, if there is a store
+// and it matches the checksum listed in the info file of its source.
+func (p *pullThrough) pull(w http.ResponseWriter, r *http.Request, key string) error {
+	name := gemFilePattern.FindStringSubmatch(path.Base(r.URL.Path))[1]
+	var (
+		res  *http.Response
+		src  *upstream
+		lerr error
+	)
+	for _, u := range p.upstreams.For(name) {
+		req, err := u.newRequest(r.Method, r.URL.Path)
+		if err != nil {
+			return err
+		}
+		for _, h := range []string{"Range", "If-None-Match", "If-Modified-Since"} {
+			if v := r.Header.Get(h); v != "" {
+				req.Header.Set(h, v)
+			}
+		}
+		res, err = u.gemClient.Do(req)
+		if err == nil && res.StatusCode == http.StatusNotFound {
+			res.Body.Close()
+			res = nil
+			continue
+		}
+		if err == nil && (res.StatusCode < 200 || res.StatusCode > 299) && res.StatusCode != http.StatusNotModified {
+			res.Body.Close()
+			err = fmt.Errorf("upstream %s: unexpected status %s", u.name, res.Status)
+			res = nil
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("upstream", u.name).Warn("upstream failed, trying next")
+			lerr = err
+			continue
+		}
+		src = u
+		break
+	}
+	if res == nil && lerr != nil {
+		http.Error(w, lerr.Error(), http.StatusBadGateway)
+		return lerr
+	}
+	if res == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	defer res.Body.Close()
+
+	for _, h := range []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified"} {
+		if v := res.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	if p.store == nil || r.Method != http.MethodGet || res.StatusCode != http.StatusOK {
+		w.WriteHeader(res.StatusCode)
+		_, err := io.Copy(w, res.Body)
+		return err
+	}
+
+	spool, err := ioutil.TempFile("", "gemserve-pull-")
+	if err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(w, io.TeeReader(res.Body, io.MultiWriter(spool, h)))
+	if err != nil {
+		return err
+	}
+	if res.ContentLength >= 0 && n != res.ContentLength {
+		return fmt.Errorf("short read: expected %d bytes; got %d", res.ContentLength, n)
+	}
+	checksum, err := upstreamChecksum(src, name, path.Base(r.URL.Path))
+	if err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != checksum {
+		return fmt.Errorf("checksum mismatch: expected %s; got %s", checksum, sum)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = p.store.Put(key, spool, "application/octet-stream")
+	return err
+}
+
+// upstreamChecksum returns the sha256 checksum of the gem file listed in
+// the info file of the source.
+func upstreamChecksum(u *upstream, name, file string) (string, error) {
+	body, _, err := u.Info(name)
+	if err != nil {
+		return "", err
+	}
+	deps, err := parseInfo(name, body)
+	if err != nil {
+		return "", err
+	}
+	for _, md := range deps {
+		if md.FullName()+".gem" == file && md.Checksum != "" {
+			return md.Checksum, nil
+		}
+	}
+	return "", fmt.Errorf("no checksum listed for %s", file)
+}
+
+// Expire removes the upstream gems stored more than retention ago.
+// Retention is by age rather than last use, as storage does not record
+// reads: a gem still being downloaded is expired all the same, and pulled
+// again on its next download.
+func (p *pullThrough) Expire(retention time.Duration) error {
+	objects, err := p.store.List(upstreamPrefix + "gems/")
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if time.Since(obj.LastModified) < retention {
+			continue
+		}
+		logrus.WithField("key", obj.Key).Debug("expiring upstream gem")
+		if err := p.store.Delete(obj.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPullThrough(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStorage(dir)
+
+	var hits int
+	sum := sha256.Sum256([]byte("rack"))
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gems/rack-2.0.0.gem", "/gems/rack-1.0.0.gem":
+			hits++
+			w.Write([]byte("rack"))
+		case "/info/rack":
+			// rack-1.0.0 is listed with the wrong checksum
+			w.Write([]byte("---\n1.0.0 |checksum:0000\n2.0.0 |checksum:" + hex.EncodeToString(sum[:]) + "\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer source.Close()
+	up := &upstreamSet{sources: []*upstream{{base: source.URL}}}
+	pull := &pullThrough{store: store, upstreams: up, fallback: http.NotFound}
+
+	for n := 0; n < 2; n++ {
+		rec := httptest.NewRecorder()
+		pull.ServeHTTP(rec, httptest.NewRequest("GET", "/gems/rack-2.0.0.gem", nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "rack" {
+			t.Errorf("expected upstream gem; got %d %q", rec.Code, rec.Body.String())
+		}
+	}
+	if hits != 1 {
+		t.Errorf("expected gem to be pulled once; got %d", hits)
+	}
+
+	rec := httptest.NewRecorder()
+	pull.ServeHTTP(rec, httptest.NewRequest("GET", "/gems/rack-1.0.0.gem", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "rack" {
+		t.Errorf("expected upstream gem; got %d %q", rec.Code, rec.Body.String())
+	}
+	if _, err := store.Stat(upstreamPrefix + "gems/rack-1.0.0.gem"); err != ErrObjectNotFound {
+		t.Errorf("expected gem with a checksum mismatch not to be stored; got %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	pull.ServeHTTP(rec, httptest.NewRequest("GET", "/gems/missing-1.0.0.gem", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected missing upstream gem to be not found; got %d", rec.Code)
+	}
+	if _, err := store.Stat(upstreamPrefix + "gems/missing-1.0.0.gem"); err != ErrObjectNotFound {
+		t.Errorf("expected missing gem not to be stored; got %v", err)
+	}
+
+	if err := pull.Expire(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat(upstreamPrefix + "gems/rack-2.0.0.gem"); err != ErrObjectNotFound {
+		t.Errorf("expected expired gem to be removed; got %v", err)
+	}
+}
+
+func TestPullThroughFallback(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	denied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "", http.StatusForbidden)
+	}))
+	defer denied.Close()
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("rack"))
+	}))
+	defer source.Close()
+
+	up := &upstreamSet{sources: []*upstream{{base: failing.URL}, {base: denied.URL}, {base: source.URL}}}
+	pull := &pullThrough{upstreams: up, fallback: http.NotFound}
+	rec := httptest.NewRecorder()
+	pull.ServeHTTP(rec, httptest.NewRequest("GET", "/gems/rack-2.0.0.gem", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "rack" {
+		t.Errorf("expected gem from the next source; got %d %q", rec.Code, rec.Body.String())
+	}
+
+	up.sources = up.sources[:2]
+	rec = httptest.NewRecorder()
+	pull.ServeHTTP(rec, httptest.NewRequest("GET", "/gems/rack-2.0.0.gem", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected 502 when all sources fail; got %d", rec.Code)
+	}
+}
+
+func TestPullThroughSlowDownload(t *testing.T) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "8")
+		w.Write([]byte("rack"))
+		w.(http.Flusher).Flush()
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("rack"))
+	}))
+	defer source.Close()
+
+	// gems are downloaded without the timeout of metadata requests
+	up := &upstreamSet{sources: []*upstream{{base: source.URL, client: http.Client{Timeout: 50 * time.Millisecond}}}}
+	pull := &pullThrough{upstreams: up, fallback: http.NotFound}
+	rec := httptest.NewRecorder()
+	pull.ServeHTTP(rec, httptest.NewRequest("GET", "/gems/rack-2.0.0.gem", nil))
+	if rec.Body.String() != "rackrack" {
+		t.Errorf("expected the whole gem; got %q", rec.Body.String())
+	}
+}
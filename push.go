@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// stagingPrefix holds gems being pushed, at staging/<full name>/<id>.gem,
+// until they are published. A staged gem left behind marks a push that did
+// not finish.
+const stagingPrefix = "staging/"
+
+// stalePushAge is how old a staged gem must be before its push is
+// considered abandoned.
+const stalePushAge = time.Hour
+
+// Push stores the gem read from file and adds it to the index. Yanked
+// versions are duplicates, and cannot be pushed again. The gem is
+// staged and verified, published under gems/ without replacing an existing
+// object, verified again and only then indexed, so the index never
+// references a gem that cannot be downloaded.
+// A failed push is rolled back unless the persisted index lists the gem;
+// one interrupted by a crash is rolled back by RecoverPushes.
+func (i *Index) Push(gem *Gem, file io.ReadSeeker) (*ObjectInfo, error) {
+	name := gem.FullName()
+	log := logrus.WithField("gem", name)
+
+	i.mu.Lock()
+	_, md := i.find(gem.Name, gem.Number, gem.Platform)
+	i.mu.Unlock()
+	if md != nil {
+		return nil, ErrDuplicateGem
+	}
+	if yanked, err := i.yanked(name); err != nil {
+		return nil, err
+	} else if yanked {
+		return nil, ErrDuplicateGem
+	}
+
+	var spec bytes.Buffer
+	if err := writeGemspec(&spec, gem.Spec); err != nil {
+		return nil, err
+	}
+
+	staged := fmt.Sprintf("%s%s/%x.gem", stagingPrefix, name, rand.Int63())
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := i.store.Put(staged, file, "application/octet-stream"); err != nil {
+		return nil, err
+	}
+	if err := i.verify(staged, gem.Checksum); err != nil {
+		i.store.Delete(staged)
+		return nil, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		i.store.Delete(staged)
+		return nil, err
+	}
+	info, err := i.store.PutIfMatch(gemKey(name), file, "application/octet-stream", "")
+	if err != nil {
+		i.store.Delete(staged)
+		if err == ErrPreconditionFailed {
+			// a concurrent push of the same gem, or a gem yanked before
+			// yanks moved its objects
+			return nil, ErrDuplicateGem
+		}
+		return nil, err
+	}
+	// the published object is the one downloaded, so it is verified too
+	err = i.verify(gemKey(name), gem.Checksum)
+	if err == nil {
+		_, err = i.store.Put(gemspecKey(name), bytes.NewReader(spec.Bytes()), "application/octet-stream")
+	}
+	if err == nil {
+		err = i.Put(gem.Metadata)
+	}
+	if err != nil {
+		// a failed index write may still have been applied, in which
+		// case the published objects must be kept
+		indexed, ierr := i.indexed(name)
+		switch {
+		case ierr != nil:
+			// the staged gem is kept so RecoverPushes settles the push
+			log.WithError(ierr).Error("push failed and the index could not be checked")
+			return nil, err
+		case !indexed:
+			log.WithError(err).Warn("push failed, rolling back")
+			if rerr := i.unpublish(name); rerr != nil {
+				// the staged gem is kept so RecoverPushes retries the rollback
+				log.WithError(rerr).Error("rollback failed")
+				return nil, err
+			}
+			i.store.Delete(staged)
+			return nil, err
+		}
+		log.WithError(err).Warn("push reported failure but the gem was indexed")
+		if err := i.Refresh(); err != nil {
+			log.WithError(err).Warn("failed to refresh index")
+		}
+	}
+
+	if err := i.store.Delete(staged); err != nil {
+		log.WithError(err).Warn("failed to remove staged gem")
+	}
+	return info, nil
+}
+
+// verify checks that the object at key has the sha256 checksum.
+func (i *Index) verify(key, checksum string) error {
+	rc, _, err := i.store.Get(key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != checksum {
+		return fmt.Errorf("%s: checksum mismatch: expected %s; got %s", key, checksum, sum)
+	}
+	return nil
+}
+
+// indexed reports whether the persisted index lists the gem with the full
+// name. It is read from storage, as the in memory index is not updated when
+// a write fails, even if the write was applied.
+func (i *Index) indexed(name string) (bool, error) {
+	gems, _, err := i.read()
+	if err != nil {
+		return false, err
+	}
+	for _, gem := range gems {
+		if gem.FullName() == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// unpublish removes the stored objects of the gem with the full name.
+func (i *Index) unpublish(name string) error {
+	if err := i.store.Delete(gemspecKey(name)); err != nil {
+		return err
+	}
+	return i.store.Delete(gemKey(name))
+}
+
+// pushing reports whether a push of the gem with the full name may still
+// be in progress.
+func (i *Index) pushing(name string) (bool, error) {
+	staged, err := i.store.List(stagingPrefix + name + "/")
+	return len(staged) > 0, err
+}
+
+// RecoverPushes cleans up after pushes staged more than maxAge ago that
+// did not finish. Gems that made it into the index are kept, the objects
+// of any others are removed.
+func (i *Index) RecoverPushes(maxAge time.Duration) error {
+	staged, err := i.store.List(stagingPrefix)
+	if err != nil {
+		return err
+	}
+	for _, obj := range staged {
+		if time.Since(obj.LastModified) < maxAge {
+			continue
+		}
+		name := strings.TrimPrefix(obj.Key, stagingPrefix)
+		if n := strings.LastIndex(name, "/"); n >= 0 {
+			name = name[:n]
+		}
+		log := logrus.WithFields(logrus.Fields{"gem": name, "key": obj.Key})
+
+		indexed, err := i.indexed(name)
+		if err != nil {
+			return err
+		}
+		if !indexed {
+			log.Warn("rolling back abandoned push")
+			if err := i.unpublish(name); err != nil {
+				return err
+			}
+		}
+		if err := i.store.Delete(obj.Key); err != nil {
+			return err
+		}
+		log.Info("recovered abandoned push")
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestIndexPush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStorage(dir)
+	idx, _ := LoadIndex(store, DependencyAPIEndpoint)
+
+	raw := buildGem(t, "testdata/sinatra-metadata.yaml")
+	gem, err := LoadGem(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idx.Push(gem, bytes.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idx.Push(gem, bytes.NewReader(raw)); err != ErrDuplicateGem {
+		t.Errorf("expected duplicate push to fail; got %v", err)
+	}
+
+	if deps := idx.Deps(); len(deps) != 1 || deps[0].FullName() != "sinatra-2.0.0" {
+		t.Errorf("expected pushed gem to be indexed; got %+v", deps)
+	}
+	for _, key := range []string{gemKey("sinatra-2.0.0"), gemspecKey("sinatra-2.0.0")} {
+		if _, err := store.Stat(key); err != nil {
+			t.Errorf("%s: %v", key, err)
+		}
+	}
+	if staged, _ := store.List(stagingPrefix); len(staged) != 0 {
+		t.Errorf("expected no staged gems; got %+v", staged)
+	}
+}
+
+func TestIndexRecoverPushes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStorage(dir)
+	idx, _ := LoadIndex(store, DependencyAPIEndpoint)
+
+	// a push that crashed after publishing the gem but before indexing it
+	store.Put(stagingPrefix+"foo-1.0.0/1.gem", bytes.NewReader(nil), "")
+	store.Put(gemKey("foo-1.0.0"), bytes.NewReader(nil), "")
+	// a push that crashed before removing the staged gem
+	idx.Put(Metadata{Name: "bar", Number: "1.0.0", Platform: "ruby"})
+	store.Put(stagingPrefix+"bar-1.0.0/1.gem", bytes.NewReader(nil), "")
+	store.Put(gemKey("bar-1.0.0"), bytes.NewReader(nil), "")
+
+	if err := idx.RecoverPushes(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat(gemKey("foo-1.0.0")); err != ErrObjectNotFound {
+		t.Errorf("expected unindexed gem to be removed; got %v", err)
+	}
+	if _, err := store.Stat(gemKey("bar-1.0.0")); err != nil {
+		t.Errorf("expected indexed gem to be kept; got %v", err)
+	}
+	if staged, _ := store.List(stagingPrefix); len(staged) != 0 {
+		t.Errorf("expected no staged gems; got %+v", staged)
+	}
+}
+
+// faultyStorage corrupts the published gems, or fails index writes after
+// applying them.
+type faultyStorage struct {
+	Storage
+	corruptGems  bool
+	failIndexPut bool
+}
+
+func (s *faultyStorage) PutIfMatch(key string, r io.Reader, contentType, etag string) (*ObjectInfo, error) {
+	if s.corruptGems && strings.HasPrefix(key, "gems/") {
+		r = io.LimitReader(r, 10)
+	}
+	info, err := s.Storage.PutIfMatch(key, r, contentType, etag)
+	if s.failIndexPut && strings.HasSuffix(key, ".json") && err == nil {
+		return nil, errors.New("connection reset")
+	}
+	return info, err
+}
+
+func TestIndexPushFaults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, _ := NewFileStorage(dir)
+	store := &faultyStorage{Storage: fs, corruptGems: true}
+	idx, _ := LoadIndex(store, DependencyAPIEndpoint)
+
+	raw := buildGem(t, "testdata/sinatra-metadata.yaml")
+	gem, err := LoadGem(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idx.Push(gem, bytes.NewReader(raw)); err == nil {
+		t.Error("expected push of a corrupted gem to fail")
+	}
+	if _, err := fs.Stat(gemKey("sinatra-2.0.0")); err != ErrObjectNotFound {
+		t.Errorf("expected corrupted gem to be removed; got %v", err)
+	}
+	if len(idx.Deps()) != 0 {
+		t.Errorf("expected corrupted gem not to be indexed; got %+v", idx.Deps())
+	}
+
+	// the index write is applied but reported as failed
+	store.corruptGems, store.failIndexPut = false, true
+	if _, err := idx.Push(gem, bytes.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(gemKey("sinatra-2.0.0")); err != nil {
+		t.Errorf("expected indexed gem to be kept; got %v", err)
+	}
+	if deps := idx.Deps(); len(deps) != 1 {
+		t.Errorf("expected gem to be indexed; got %+v", deps)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// IndexDiff lists the gems, by full name, that differ between two indexes.
+type IndexDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+	// Backfill lists the gems indexed without a checksum, as they were
+	// before checksums were recorded, and otherwise unchanged
+	Backfill []string `json:"backfill"`
+	// Skipped lists the stored objects that are not valid gems
+	Skipped []string `json:"skipped"`
+	// Corrupt reports that the current index could not be parsed, and was
+	// compared as an empty index
+	Corrupt bool `json:"corrupt,omitempty"`
+}
+
+// Empty reports whether the indexes are the same.
+func (d *IndexDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0 && len(d.Backfill) == 0
+}
+
+// diffIndex compares the gems of the current index with the next one. A
+// gem without a checksum in the current index has an unknown checksum
+// rather than a different one.
+func diffIndex(current, next []Metadata) *IndexDiff {
+	diff := &IndexDiff{}
+	byName := make(map[string]Metadata, len(current))
+	for _, md := range current {
+		byName[md.FullName()] = md
+	}
+	for _, md := range next {
+		cur, ok := byName[md.FullName()]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, md.FullName())
+		case !reflect.DeepEqual(cur.Dependencies, md.Dependencies):
+			diff.Changed = append(diff.Changed, md.FullName())
+		case cur.Checksum == "" && md.Checksum != "":
+			diff.Backfill = append(diff.Backfill, md.FullName())
+		case cur.Checksum != md.Checksum:
+			diff.Changed = append(diff.Changed, md.FullName())
+		}
+		delete(byName, md.FullName())
+	}
+	for _, md := range current {
+		if _, ok := byName[md.FullName()]; ok {
+			diff.Removed = append(diff.Removed, md.FullName())
+		}
+	}
+	return diff
+}
+
+// Reindex rebuilds the index from the .gem objects stored under gems/ and
+// replaces the persisted index with it in a single write. With dryRun the
+// index is left untouched and only the differences are reported. A
+// corrupt persisted index is replaced as if it were empty.
+func (i *Index) Reindex(dryRun bool) (*IndexDiff, error) {
+	for attempt := 1; ; attempt++ {
+		current, info, err := i.load()
+		_, corrupt := err.(corruptIndexError)
+		if corrupt {
+			logrus.WithError(err).Warn("replacing corrupt index")
+		} else if err != nil {
+			return nil, err
+		}
+		gems, skipped, err := i.scan()
+		if err != nil {
+			return nil, err
+		}
+		diff := diffIndex(current, gems)
+		diff.Skipped = skipped
+		diff.Corrupt = corrupt
+		if dryRun {
+			return diff, nil
+		}
+
+		var etag string
+		if info != nil {
+			etag = info.ETag
+		}
+		i.mu.Lock()
+		info, err = i.write(gems, etag)
+		if err == nil {
+			i.apply(gems, info)
+		}
+		i.mu.Unlock()
+		if err != ErrPreconditionFailed || attempt == maxIndexAttempts {
+			return diff, err
+		}
+		logrus.WithField("attempt", attempt).Warn("index changed during reindex, retrying")
+	}
+}
+
+// scan loads every stored gem that was not yanked, returning the keys of
+// those that are not valid gems alongside the sorted metadata of the rest.
+// A failure to read a gem from storage aborts the scan, so that an index
+// built from it never drops gems that are only temporarily unreadable.
+func (i *Index) scan() (gems []Metadata, skipped []string, err error) {
+	objects, err := i.store.List("gems/")
+	if err != nil {
+		return nil, nil, err
+	}
+	yanked, err := i.store.List(yankedPrefix + "gems/")
+	if err != nil {
+		return nil, nil, err
+	}
+	// yanked gems are never added back, even if a failed yank left them
+	// under gems/
+	yankedKeys := make(map[string]bool, len(yanked))
+	for _, obj := range yanked {
+		yankedKeys[strings.TrimPrefix(obj.Key, yankedPrefix)] = true
+	}
+	seen := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		if !strings.HasSuffix(obj.Key, ".gem") || yankedKeys[obj.Key] {
+			continue
+		}
+		log := logrus.WithField("key", obj.Key)
+		gem, err := i.loadStoredGem(obj.Key)
+		if serr, ok := err.(storageError); ok {
+			if serr.err == ErrObjectNotFound {
+				// deleted since it was listed
+				continue
+			}
+			return nil, nil, fmt.Errorf("%s: %v", obj.Key, err)
+		}
+		if err != nil {
+			log.WithError(err).Warn("skipping invalid gem")
+			skipped = append(skipped, obj.Key)
+			continue
+		}
+		if seen[gem.FullName()] {
+			log.Warn("skipping duplicate gem")
+			skipped = append(skipped, obj.Key)
+			continue
+		}
+		seen[gem.FullName()] = true
+		gems = append(gems, gem.Metadata)
+	}
+	sortMetadata(gems)
+	return gems, skipped, nil
+}
+
+// storageError is a failure to read a stored object, as opposed to a
+// failure to parse it.
+type storageError struct {
+	err error
+}
+
+func (e storageError) Error() string {
+	return e.err.Error()
+}
+
+// readErrorReader records the errors of the underlying reader other than
+// io.EOF.
+type readErrorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrorReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// loadStoredGem reads and parses the gem stored at key. Failures to read
+// the object are returned as a storageError.
+func (i *Index) loadStoredGem(key string) (*Gem, error) {
+	rc, _, err := i.store.Get(key)
+	if err != nil {
+		return nil, storageError{err}
+	}
+	defer rc.Close()
+	r := &readErrorReader{r: rc}
+	gem, err := LoadGem(r)
+	if r.err != nil {
+		return nil, storageError{r.err}
+	}
+	return gem, err
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffIndex(t *testing.T) {
+	current := []Metadata{
+		{Name: "foo", Number: "1.0.0", Platform: "ruby", Checksum: "a"},
+		{Name: "foo", Number: "1.1.0", Platform: "ruby", Checksum: "b"},
+		{Name: "bar", Number: "2.0.0", Platform: "ruby"},
+	}
+	next := []Metadata{
+		{Name: "foo", Number: "1.0.0", Platform: "ruby", Checksum: "a"},
+		{Name: "foo", Number: "1.1.0", Platform: "ruby", Checksum: "c"},
+		{Name: "baz", Number: "0.1.0", Platform: "x86_64-linux"},
+	}
+	diff := diffIndex(current, next)
+	expected := &IndexDiff{
+		Added:   []string{"baz-0.1.0-x86_64-linux"},
+		Removed: []string{"bar-2.0.0"},
+		Changed: []string{"foo-1.1.0"},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("expected %+v; got %+v", expected, diff)
+	}
+	if diffIndex(next, next).Empty() != true {
+		t.Error("expected no changes between identical indexes")
+	}
+}
+
+// failingGetStorage fails to read the objects in failing.
+type failingGetStorage struct {
+	Storage
+	failing map[string]bool
+}
+
+func (s *failingGetStorage) Get(key string) (io.ReadCloser, *ObjectInfo, error) {
+	if s.failing[key] {
+		return nil, nil, errors.New("connection reset")
+	}
+	return s.Storage.Get(key)
+}
+
+func TestReindexStorageError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, _ := NewFileStorage(dir)
+	store := &failingGetStorage{Storage: fs, failing: make(map[string]bool)}
+	idx, _ := LoadIndex(store, DependencyAPIEndpoint)
+
+	raw := buildGem(t, "testdata/sinatra-metadata.yaml")
+	gem, err := LoadGem(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idx.Push(gem, bytes.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+	fs.Put(gemKey("broken-1.0.0"), strings.NewReader("not a gem"), "")
+
+	diff, err := idx.Reindex(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.Empty() || len(diff.Skipped) != 1 || diff.Skipped[0] != gemKey("broken-1.0.0") {
+		t.Errorf("expected only the invalid gem to be skipped; got %+v", diff)
+	}
+
+	store.failing[gemKey("sinatra-2.0.0")] = true
+	if _, err := idx.Reindex(false); err == nil {
+		t.Error("expected reindex to fail when a gem cannot be read")
+	}
+	if deps := idx.Deps(); len(deps) != 1 || deps[0].FullName() != "sinatra-2.0.0" {
+		t.Errorf("expected the index to keep the unreadable gem; got %+v", deps)
+	}
+}
+
+func TestReindexCorruptIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStorage(dir)
+	idx, _ := LoadIndex(store, DependencyAPIEndpoint)
+
+	raw := buildGem(t, "testdata/sinatra-metadata.yaml")
+	gem, err := LoadGem(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idx.Push(gem, bytes.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+	store.Put(idx.keyJSON(), strings.NewReader(`[{"name": "sinatra"`), "application/json")
+	if _, err := LoadIndex(store, DependencyAPIEndpoint); err == nil {
+		t.Fatal("expected corrupt index to fail to load")
+	}
+
+	diff, err := newIndex(store, DependencyAPIEndpoint).Reindex(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.Corrupt || !reflect.DeepEqual(diff.Added, []string{"sinatra-2.0.0"}) {
+		t.Errorf("expected corrupt index to be replaced; got %+v", diff)
+	}
+	idx, err = LoadIndex(store, DependencyAPIEndpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deps := idx.Lookup("sinatra"); len(deps) != 1 {
+		t.Errorf("expected rebuilt index; got %v", deps)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// maxUpstreamRequests bounds the concurrent requests made to resolve dependencies.
+const maxUpstreamRequests = 8
+
+// sourceNamePattern restricts source names, which namespace their cached
+// files, so they cannot collide with the stored upstream gems.
+var sourceNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+// upstreamConfig is the JSON configuration of the upstream sources.
+// Environment variables in it are expanded, so that credentials can be
+// kept out of the file.
+//
+//	{
+//	  "upstreams": [
+//	    {"name": "sidekiq", "url": "https://gems.contribsys.com", "username": "$SIDEKIQ_USER", "password": "$SIDEKIQ_PASSWORD"},
+//	    {"name": "rubygems", "url": "https://api.rubygems.org", "headers": {"User-Agent": "gemserve"}}
+//	  ],
+//	  "routes": [
+//	    {"pattern": "sidekiq-*", "upstreams": ["sidekiq"]}
+//	  ]
+//	}
+type upstreamConfig struct {
+	Upstreams []struct {
+		Name     string            `json:"name"`
+		URL      string            `json:"url"`
+		Username string            `json:"username"`
+		Password string            `json:"password"`
+		Headers  map[string]string `json:"headers"`
+	} `json:"upstreams"`
+	// Routes map gem names matching a path.Match pattern to the sources
+	// they are fetched from. The first matching route applies.
+	Routes []struct {
+		Pattern   string   `json:"pattern"`
+		Upstreams []string `json:"upstreams"`
+	} `json:"routes"`
+}
+
+// upstreamSet is the ordered list of upstream sources. A gem is fetched
+// from the first of its sources that knows it, falling back to the next
+// when a source does not know the gem or fails.
+type upstreamSet struct {
+	sources []*upstream
+	routes  []upstreamRoute
+}
+
+type upstreamRoute struct {
+	pattern string
+	sources []*upstream
+}
+
+// loadUpstreams reads the upstream configuration file at name. Metadata is
+// fetched with client and gems downloaded with gemClient.
+func loadUpstreams(name string, client, gemClient http.Client, cache *metadataCache) (*upstreamSet, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var config upstreamConfig
+	if err := json.Unmarshal([]byte(os.ExpandEnv(string(b))), &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	set := &upstreamSet{}
+	byName := make(map[string]*upstream)
+	for _, c := range config.Upstreams {
+		if !sourceNamePattern.MatchString(c.Name) || c.Name == "gems" || byName[c.Name] != nil {
+			return nil, fmt.Errorf("%s: invalid or duplicate upstream name %q", name, c.Name)
+		}
+		if c.URL == "" {
+			return nil, fmt.Errorf("%s: upstream %s has no url", name, c.Name)
+		}
+		u := &upstream{
+			name:      c.Name,
+			client:    client,
+			gemClient: gemClient,
+			base:      c.URL,
+			username:  c.Username,
+			password:  c.Password,
+			header:    http.Header{},
+			cache:     cache,
+		}
+		for k, v := range c.Headers {
+			u.header.Set(k, v)
+		}
+		byName[c.Name] = u
+		set.sources = append(set.sources, u)
+	}
+	if len(set.sources) == 0 {
+		return nil, fmt.Errorf("%s: no upstreams", name)
+	}
+
+	for _, c := range config.Routes {
+		if _, err := path.Match(c.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s: route %q: %v", name, c.Pattern, err)
+		}
+		route := upstreamRoute{pattern: c.Pattern}
+		for _, n := range c.Upstreams {
+			u, ok := byName[n]
+			if !ok {
+				return nil, fmt.Errorf("%s: route %q: unknown upstream %q", name, c.Pattern, n)
+			}
+			route.sources = append(route.sources, u)
+		}
+		set.routes = append(set.routes, route)
+	}
+	return set, nil
+}
+
+// Load adds the files of the sources already in the cache.
+func (s *upstreamSet) Load() error {
+	for _, u := range s.sources {
+		if u.cache == nil {
+			continue
+		}
+		if err := u.cache.Load(u.cachePath("/versions"), u.cachePath("/info/")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// For returns the sources of the named gem, in the order they are tried.
+func (s *upstreamSet) For(name string) []*upstream {
+	for _, route := range s.routes {
+		if ok, _ := path.Match(route.pattern, name); ok {
+			return route.sources
+		}
+	}
+	return s.sources
+}
+
+// Proxied returns the source proxied requests for p are sent to: the first
+// source of the gem for gem files and quick index gemspecs, and the first
+// source otherwise, as other paths do not name a gem.
+func (s *upstreamSet) Proxied(p string) *upstream {
+	file := path.Base(p)
+	if path.Dir(p) == "/quick/Marshal.4.8" && strings.HasSuffix(file, ".gemspec.rz") {
+		file = strings.TrimSuffix(file, "spec.rz")
+	} else if path.Dir(p) != "/gems" {
+		return s.sources[0]
+	}
+	if m := gemFilePattern.FindStringSubmatch(file); m != nil {
+		return s.For(m[1])[0]
+	}
+	return s.sources[0]
+}
+
+// Info returns the compact index info file for name from the first of its
+// sources that knows it.
+func (s *upstreamSet) Info(name string) (body []byte, stale bool, err error) {
+	err = ErrUpstreamNotFound
+	for _, u := range s.For(name) {
+		b, st, uerr := u.Info(name)
+		if uerr == nil {
+			return b, st, nil
+		}
+		if uerr != ErrUpstreamNotFound {
+			logrus.WithError(uerr).WithField("upstream", u.name).Warn("upstream failed, trying next")
+			err = uerr
+		}
+	}
+	return nil, false, err
+}
+
+// Versions returns the compact index versions file of the sources. Failed
+// sources are left out, and the result is then marked as stale.
+func (s *upstreamSet) Versions() (body []byte, stale bool, err error) {
+	if len(s.sources) == 1 {
+		return s.sources[0].Versions()
+	}
+
+	files := make([][]byte, len(s.sources))
+	found := false
+	for n, u := range s.sources {
+		b, st, uerr := u.Versions()
+		switch {
+		case uerr == ErrUpstreamNotFound:
+		case uerr != nil:
+			logrus.WithError(uerr).WithField("upstream", u.name).Warn("upstream failed, leaving it out")
+			stale = true
+			err = uerr
+		default:
+			files[n] = b
+			found = true
+			stale = stale || st
+		}
+	}
+	if !found {
+		if err == nil {
+			err = ErrUpstreamNotFound
+		}
+		return nil, false, err
+	}
+	return s.mergeVersions(files), stale, nil
+}
+
+// mergeVersions combines the versions files of the sources. The lines of a
+// gem are only kept from the first of its sources to list it, which is
+// the source its info file is served from.
+func (s *upstreamSet) mergeVersions(files [][]byte) []byte {
+	var (
+		buf    bytes.Buffer
+		lines  = make([][][]byte, len(files))
+		listed = make(map[*upstream]map[string]bool, len(files))
+	)
+	for n, file := range files {
+		listed[s.sources[n]] = make(map[string]bool)
+		if file == nil {
+			continue
+		}
+		header, body := file, []byte(nil)
+		if i := bytes.Index(file, []byte("\n---\n")); i >= 0 {
+			header, body = file[:i+5], file[i+5:]
+		}
+		if buf.Len() == 0 {
+			buf.Write(header)
+		}
+		for _, line := range bytes.SplitAfter(body, []byte("\n")) {
+			if i := bytes.IndexByte(line, ' '); i > 0 {
+				listed[s.sources[n]][string(line[:i])] = true
+				lines[n] = append(lines[n], line)
+			}
+		}
+	}
+
+	owner := func(name string) *upstream {
+		for _, u := range s.For(name) {
+			if listed[u][name] {
+				return u
+			}
+		}
+		return nil
+	}
+	for n := range files {
+		for _, line := range lines[n] {
+			if owner(string(line[:bytes.IndexByte(line, ' ')])) == s.sources[n] {
+				buf.Write(line)
+				if line[len(line)-1] != '\n' {
+					buf.WriteByte('\n')
+				}
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// Deps returns the versions of the named gems known to the upstream sources,
+// as read from their info files. Unknown gems are skipped.
+func (s *upstreamSet) Deps(names ...string) (deps []Metadata, stale bool, err error) {
+	var (
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, maxUpstreamRequests)
+		results = make([][]Metadata, len(names))
+		stales  = make([]bool, len(names))
+		errs    = make([]error, len(names))
+	)
+	for n, name := range names {
+		if name == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(n int, name string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			body, stale, err := s.Info(name)
+			stales[n] = stale
+			if err == ErrUpstreamNotFound {
+				return
+			}
+			if err != nil {
+				errs[n] = err
+				return
+			}
+			results[n], errs[n] = parseInfo(name, body)
+		}(n, name)
+	}
+	wg.Wait()
+
+	for n := range names {
+		if errs[n] != nil {
+			return nil, false, errs[n]
+		}
+		deps = append(deps, results[n]...)
+		stale = stale || stales[n]
+	}
+	return deps, stale, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpstreamSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	public := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/versions":
+			w.Write([]byte("created_at: 2017-01-01\n---\nrack 2.0.0 aaa\nsidekiq-pro 9.9.9 bbb\n"))
+		case "/info/rack", "/info/sidekiq-pro":
+			w.Write([]byte("---\n2.0.0 |checksum:public\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer public.Close()
+	vendor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "user" || pass != "secret" || r.Header.Get("X-Vendor") != "1" {
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/versions":
+			w.Write([]byte("created_at: 2017-01-01\n---\nsidekiq-pro 5.0.0 ccc\n"))
+		case "/info/sidekiq-pro":
+			w.Write([]byte("---\n5.0.0 |checksum:vendor\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer vendor.Close()
+
+	config := filepath.Join(dir, "upstreams.json")
+	os.Setenv("TEST_VENDOR_PASSWORD", "secret")
+	ioutil.WriteFile(config, []byte(`{
+		"upstreams": [
+			{"name": "rubygems", "url": "`+public.URL+`"},
+			{"name": "vendor", "url": "`+vendor.URL+`", "username": "user", "password": "$TEST_VENDOR_PASSWORD", "headers": {"X-Vendor": "1"}}
+		],
+		"routes": [{"pattern": "sidekiq-*", "upstreams": ["vendor", "rubygems"]}]
+	}`), 0644)
+	up, err := loadUpstreams(config, http.Client{}, http.Client{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body, _, err := up.Info("sidekiq-pro"); err != nil || string(body) != "---\n5.0.0 |checksum:vendor\n" {
+		t.Errorf("expected routed gem from vendor; got %q, %v", body, err)
+	}
+	if body, _, err := up.Info("rack"); err != nil || string(body) != "---\n2.0.0 |checksum:public\n" {
+		t.Errorf("expected gem from rubygems; got %q, %v", body, err)
+	}
+	if _, _, err := up.Info("missing"); err != ErrUpstreamNotFound {
+		t.Errorf("expected unknown gem to be not found; got %v", err)
+	}
+
+	for p, source := range map[string]string{
+		"/gems/sidekiq-pro-5.0.0.gem":                     "vendor",
+		"/quick/Marshal.4.8/sidekiq-pro-5.0.0.gemspec.rz": "vendor",
+		"/gems/rack-2.0.0.gem":                            "rubygems",
+		"/specs.4.8.gz":                                   "rubygems",
+	} {
+		if u := up.Proxied(p); u.name != source {
+			t.Errorf("%s: expected to be proxied to %s; got %s", p, source, u.name)
+		}
+	}
+
+	body, _, err := up.Versions()
+	expected := "created_at: 2017-01-01\n---\nrack 2.0.0 aaa\nsidekiq-pro 5.0.0 ccc\n"
+	if err != nil || string(body) != expected {
+		t.Errorf("expected merged versions %q; got %q, %v", expected, body, err)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Specification is the Gem::Specification stored in a gem's metadata.gz.
+type Specification struct {
+	Name    string
+	Version struct {
+		Version string
+	}
+	Platform                string
+	Summary                 string
+	Description             string
+	Authors                 []string
+	Email                   StringList
+	Homepage                string
+	Licenses                []string
+	Metadata                map[string]string
+	Date                    string
+	Dependencies            []Dependency
+	RequiredRubyVersion     Requirement `yaml:"required_ruby_version"`
+	RequiredRubygemsVersion Requirement `yaml:"required_rubygems_version"`
+	RubygemsVersion         string      `yaml:"rubygems_version"`
+	SpecificationVersion    int64       `yaml:"specification_version"`
+	Files                   []string
+	TestFiles               []string `yaml:"test_files"`
+	Executables             []string
+	Extensions              []string
+	ExtraRdocFiles          []string `yaml:"extra_rdoc_files"`
+	RdocOptions             []string `yaml:"rdoc_options"`
+	RequirePaths            []string `yaml:"require_paths"`
+	Requirements            []string
+	Bindir                  string
+	PostInstallMessage      string   `yaml:"post_install_message"`
+	CertChain               []string `yaml:"cert_chain"`
+	SigningKey              string   `yaml:"signing_key"`
+}
+
+// StringList is a list of strings that may be written as a single string,
+// as the email of a spec often is.
+type StringList []string
+
+// UnmarshalYAML decodes either a string or a sequence of strings.
+func (l *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		if s != "" {
+			*l = StringList{s}
+		}
+		return nil
+	}
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// Dependency is a Gem::Dependency.
+type Dependency struct {
+	Name        string
+	Type        string
+	Requirement Requirement
+	Prerelease  bool
+}
+
+// Requirement is a Gem::Requirement.
+type Requirement struct {
+	Requirements []Constraint
+}
+
+// Constraint is a single operator and version pair of a requirement.
+type Constraint struct {
+	Op      string
+	Version string
+}
+
+// UnmarshalYAML decodes the [op, Gem::Version] pair used in metadata.gz.
+func (c *Constraint) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw []interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	if len(raw) != 2 {
+		return fmt.Errorf("requirement: expected [op, version], got %v", raw)
+	}
+	op, ok := raw[0].(string)
+	if !ok {
+		return fmt.Errorf("requirement: invalid operator %v", raw[0])
+	}
+	v, ok := raw[1].(map[interface{}]interface{})
+	if !ok {
+		return fmt.Errorf("requirement: invalid version %v", raw[1])
+	}
+	version, ok := v["version"]
+	if !ok || version == nil {
+		return fmt.Errorf("requirement: missing version in %v", raw[1])
+	}
+	c.Op = op
+	c.Version = fmt.Sprint(version)
+	return nil
+}
+
+// String returns the constraint as written in a Gemfile, e.g. ">= 1.0".
+func (c Constraint) String() string {
+	return c.Op + " " + c.Version
+}
+
+// Strings returns each constraint of the requirement as a string.
+func (r Requirement) Strings() []string {
+	s := make([]string, len(r.Requirements))
+	for i, c := range r.Requirements {
+		s[i] = c.String()
+	}
+	return s
+}
+
+// IsDefault reports whether the requirement is satisfied by any version.
+func (r Requirement) IsDefault() bool {
+	for _, c := range r.Requirements {
+		if c.Op != ">=" || c.Version != "0" {
+			return false
+		}
+	}
+	return true
+}
+
+// UnmarshalSpecification decodes the YAML Gem::Specification from metadata.gz.
+func UnmarshalSpecification(b []byte) (*Specification, error) {
+	var spec Specification
+	if err := yaml.Unmarshal(b, &spec); err != nil {
+		return nil, err
+	}
+	if spec.Platform == "" {
+		spec.Platform = "ruby"
+	}
+	return &spec, nil
+}
+
+// specDateFormats are the layouts RubyGems has used to serialize the spec date.
+var specDateFormats = []string{
+	"2006-01-02 15:04:05.000000000 Z",
+	"2006-01-02 15:04:05 Z",
+	"2006-01-02",
+	time.RFC3339,
+}
+
+// defaultSpecDate is the date RubyGems assigns to reproducible builds.
+var defaultSpecDate = time.Date(1980, 1, 2, 0, 0, 0, 0, time.UTC)
+
+// Time returns the parsed spec date, or the zero time if it is invalid.
+func (s *Specification) Time() time.Time {
+	for _, layout := range specDateFormats {
+		if t, err := time.Parse(layout, s.Date); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// writeGemspec writes spec as the deflated Marshal stream served from
+// quick/Marshal.4.8/<name>-<version>.gemspec.rz.
+func writeGemspec(w io.Writer, spec *Specification) error {
+	var dump bytes.Buffer
+	if err := dumpSpecification(&dump, spec); err != nil {
+		return err
+	}
+	zw := zlib.NewWriter(w)
+	g := newRubyEncoder(zw)
+	if err := g.UserDefinedObject("Gem::Specification", dump.String()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// dumpSpecification writes the Marshal stream returned by Gem::Specification#_dump.
+func dumpSpecification(w io.Writer, spec *Specification) error {
+	g := newRubyEncoder(w)
+	g.StartArray(19)
+	writeUTF8(g, spec.RubygemsVersion)
+	g.Fixnum(spec.SpecificationVersion)
+	writeUTF8(g, spec.Name)
+	writeVersion(g, spec.Version.Version)
+	date := spec.Time()
+	if date.IsZero() {
+		date = defaultSpecDate
+	}
+	writeTime(g, date)
+	writeUTF8(g, spec.Summary)
+	writeRequirement(g, spec.RequiredRubyVersion)
+	writeRequirement(g, spec.RequiredRubygemsVersion)
+	writeUTF8(g, spec.Platform)
+	g.StartArray(len(spec.Dependencies))
+	for _, dep := range spec.Dependencies {
+		g.StartObject("Gem::Dependency", 5)
+		g.Symbol("@name")
+		writeUTF8(g, dep.Name)
+		g.Symbol("@requirement")
+		writeRequirement(g, dep.Requirement)
+		g.Symbol("@type")
+		g.Symbol(dependencyType(dep.Type))
+		g.Symbol("@prerelease")
+		g.Bool(dep.Prerelease)
+		g.Symbol("@version_requirements")
+		writeRequirement(g, dep.Requirement)
+		g.EndObject()
+	}
+	g.EndArray()
+	g.Nil() // rubyforge_project
+	switch len(spec.Email) {
+	case 0:
+		g.Nil()
+	case 1:
+		writeUTF8(g, spec.Email[0])
+	default:
+		writeUTF8Array(g, spec.Email)
+	}
+	writeUTF8Array(g, spec.Authors)
+	writeUTF8(g, spec.Description)
+	writeUTF8(g, spec.Homepage)
+	g.Bool(true) // has_rdoc
+	writeUTF8(g, spec.Platform)
+	writeUTF8Array(g, spec.Licenses)
+	keys := make([]string, 0, len(spec.Metadata))
+	for k := range spec.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	g.StartHash(len(keys))
+	for _, k := range keys {
+		writeUTF8(g, k)
+		writeUTF8(g, spec.Metadata[k])
+	}
+	g.EndHash()
+	return g.EndArray()
+}
+
+func dependencyType(typ string) string {
+	if len(typ) > 1 && typ[0] == ':' {
+		return typ[1:]
+	}
+	if typ == "" {
+		return "runtime"
+	}
+	return typ
+}
+
+func writeUTF8(g *rubyEncoder, s string) {
+	g.StartIVar(1)
+	g.String(s)
+	g.Symbol("E")
+	g.Bool(true)
+	g.EndIVar()
+}
+
+func writeUTF8Array(g *rubyEncoder, a []string) {
+	g.StartArray(len(a))
+	for _, s := range a {
+		writeUTF8(g, s)
+	}
+	g.EndArray()
+}
+
+func writeVersion(g *rubyEncoder, version string) {
+	g.StartUserMarshalled("Gem::Version")
+	g.StartArray(1)
+	writeUTF8(g, version)
+	g.EndArray()
+	g.EndUserMarshalled()
+}
+
+func writeRequirement(g *rubyEncoder, req Requirement) {
+	constraints := req.Requirements
+	if len(constraints) == 0 {
+		constraints = []Constraint{{Op: ">=", Version: "0"}}
+	}
+	g.StartUserMarshalled("Gem::Requirement")
+	g.StartArray(1)
+	g.StartArray(len(constraints))
+	for _, c := range constraints {
+		g.StartArray(2)
+		writeUTF8(g, c.Op)
+		writeVersion(g, c.Version)
+		g.EndArray()
+	}
+	g.EndArray()
+	g.EndArray()
+	g.EndUserMarshalled()
+}
+
+// writeTime writes t in the UTC format of Time#_dump.
+func writeTime(g *rubyEncoder, t time.Time) {
+	t = t.UTC()
+	var b [8]byte
+	binary.LittleEndian.PutUint32(b[:4], 1<<31|1<<30|
+		uint32(t.Year()-1900)<<14|uint32(t.Month()-1)<<10|uint32(t.Day())<<5|uint32(t.Hour()))
+	binary.LittleEndian.PutUint32(b[4:], uint32(t.Minute())<<26|uint32(t.Second())<<20|uint32(t.Nanosecond()/1000))
+	g.UserDefinedObject("Time", string(b[:]))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// sinatraSpecDump is the sinatra-2.0.0 fixture as dumped by
+// Gem::Specification#_dump, one element per field in _dump order.
+var sinatraSpecDump = []string{
+	`"2.6.11"`, // rubygems_version
+	`4`,        // specification_version
+	`"sinatra"`,
+	`Gem::Version(["2.0.0"])`,
+	`Time<e0501dc000000000>`, // date, 2017-05-07 UTC
+	`"Classy web-development dressed in a DSL"`,
+	`Gem::Requirement([[[">=", Gem::Version(["2.2.0"])]]])`, // required_ruby_version
+	`Gem::Requirement([[[">=", Gem::Version(["0"])]]])`,     // required_rubygems_version
+	`"ruby"`, // original_platform
+	`[` + strings.Join([]string{
+		sinatraDependency("rack", "~>", "2.0"),
+		sinatraDependency("tilt", "~>", "2.0"),
+		sinatraDependency("rack-protection", "=", "2.0.0"),
+		sinatraDependency("mustermann", "~>", "1.0"),
+	}, ", ") + `]`,
+	`nil`, // rubyforge_project
+	`"sinatrarb@googlegroups.com"`,
+	`["Blake Mizerany", "Ryan Tomayko", "Simon Rozet", "Konstantin Haase"]`,
+	`"Sinatra is a DSL for quickly creating web applications in Ruby with minimal effort."`,
+	`"http://www.sinatrarb.com/"`,
+	`true`,   // has_rdoc
+	`"ruby"`, // new_platform
+	`["MIT"]`,
+	`{}`, // metadata
+}
+
+func sinatraDependency(name, op, version string) string {
+	req := fmt.Sprintf(`Gem::Requirement([[[%q, Gem::Version([%q])]]])`, op, version)
+	return fmt.Sprintf(`#<Gem::Dependency @name=%q, @requirement=%s, @type=:runtime, @prerelease=false, @version_requirements=%s>`, name, req, req)
+}
+
+func TestDumpSpecification(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/sinatra-metadata.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := UnmarshalSpecification(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dump bytes.Buffer
+	if err := dumpSpecification(&dump, spec); err != nil {
+		t.Fatal(err)
+	}
+	s, err := decodeMarshal(dump.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "[" + strings.Join(sinatraSpecDump, ", ") + "]"; s != expected {
+		t.Errorf("invalid spec dump\ngot:      %s\nexpected: %s", s, expected)
+	}
+
+	var rz bytes.Buffer
+	if err := writeGemspec(&rz, spec); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zlib.NewReader(&rz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = decodeMarshal(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("Gem::Specification<%x>", dump.Bytes()); s != expected {
+		t.Errorf("expected the gemspec to wrap the spec dump; got %s", s)
+	}
+}
+
+func TestIndexPersistsSpecification(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStorage(dir)
+	idx, _ := LoadIndex(store, DependencyAPIEndpoint)
+
+	raw := buildGem(t, "testdata/sinatra-metadata.yaml")
+	gem, err := LoadGem(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idx.Push(gem, bytes.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a fresh replica only has the persisted index
+	loaded, err := LoadIndex(store, DependencyAPIEndpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := loaded.Latest("sinatra")
+	if md == nil || md.Spec == nil {
+		t.Fatalf("expected the spec to be persisted; got %+v", md)
+	}
+	if !reflect.DeepEqual(md.Spec, gem.Spec) {
+		t.Errorf("persisted spec differs\ngot:      %+v\nexpected: %+v", md.Spec, gem.Spec)
+	}
+
+	var pushed, persisted bytes.Buffer
+	if err := dumpSpecification(&pushed, gem.Spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := dumpSpecification(&persisted, md.Spec); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pushed.Bytes(), persisted.Bytes()) {
+		t.Error("expected the persisted spec to dump like the pushed one")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mattaitchison/gemserve/gemver"
+)
+
+// Legacy full index files read by `gem` and `bundle install --full-index`.
+const (
+	specsFile           = "specs.4.8.gz"
+	latestSpecsFile     = "latest_specs.4.8.gz"
+	prereleaseSpecsFile = "prerelease_specs.4.8.gz"
+)
+
+// fetchSpecsHandler serves the gzipped legacy spec index named by the last
+// element of the request path.
+func fetchSpecsHandler(index *Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		b, err := index.Specs(path.Base(req.URL.Path))
+		if err != nil {
+			logrus.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if b == nil {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, req, "", index.Modified(), bytes.NewReader(b))
+	}
+}
+
+// selectSpecs returns the subset of deps listed in the legacy index file,
+// sorted by name, version and platform. A nil slice is returned for
+// unknown files.
+func selectSpecs(file string, deps []Metadata) []Metadata {
+	var selected []Metadata
+	switch file {
+	case specsFile:
+		for _, md := range deps {
+			if !md.Prerelease() {
+				selected = append(selected, md)
+			}
+		}
+	case prereleaseSpecsFile:
+		for _, md := range deps {
+			if md.Prerelease() {
+				selected = append(selected, md)
+			}
+		}
+	case latestSpecsFile:
+		latest := make(map[string]Metadata)
+		for _, md := range deps {
+			if md.Prerelease() {
+				continue
+			}
+			key := md.Name + "\x00" + normalizePlatform(md.Platform)
+			if cur, ok := latest[key]; !ok || gemver.Compare(md.Number, cur.Number) > 0 {
+				latest[key] = md
+			}
+		}
+		for _, md := range latest {
+			selected = append(selected, md)
+		}
+	default:
+		return nil
+	}
+
+	sortMetadata(selected)
+	if selected == nil {
+		selected = []Metadata{}
+	}
+	return selected
+}
+
+// writeSpecs writes the gzipped Marshal array of [name, Gem::Version, platform] tuples.
+func writeSpecs(w io.Writer, deps []Metadata) error {
+	gz := gzip.NewWriter(w)
+	g := newRubyEncoder(gz)
+	g.StartArray(len(deps))
+	for _, v := range deps {
+		platform := normalizePlatform(v.Platform)
+		g.StartArray(3)
+		g.StartIVar(0)
+		g.String(v.Name)
+		g.EndIVar()
+		g.StartUserMarshalled("Gem::Version")
+		g.StartArray(1)
+		g.StartIVar(0)
+		g.String(v.Number)
+		g.EndIVar()
+		g.EndArray()
+		g.EndUserMarshalled()
+		g.StartIVar(0)
+		g.String(platform)
+		g.EndIVar()
+		g.EndArray()
+	}
+	if err := g.EndArray(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// marshalReader decodes the subset of the Ruby Marshal 4.8 format written
+// by gemserve into a readable, Ruby-like string, so tests can compare
+// streams without depending on the encoder.
+type marshalReader struct {
+	b    []byte
+	syms []string
+	objs []string
+}
+
+// decodeMarshal returns the string form of a Marshal stream. Strings are
+// quoted, symbols prefixed by a colon, objects written as
+// #<Class @ivar=value>, user marshalled (U) objects as Class(data) and user
+// defined (u) objects as Class<hex data>. Instance variables of strings,
+// such as their encoding, are left out.
+func decodeMarshal(b []byte) (s string, err error) {
+	if len(b) < 2 || b[0] != 4 || b[1] != 8 {
+		return "", errors.New("invalid Marshal version")
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid Marshal stream: %v", r)
+		}
+	}()
+	r := &marshalReader{b: b[2:]}
+	s = r.value()
+	if len(r.b) != 0 {
+		return "", fmt.Errorf("%d trailing bytes", len(r.b))
+	}
+	return s, nil
+}
+
+func (r *marshalReader) next() byte {
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c
+}
+
+func (r *marshalReader) long() int {
+	c := int(int8(r.next()))
+	switch {
+	case c == 0:
+		return 0
+	case c > 4:
+		return c - 5
+	case c < -4:
+		return c + 5
+	}
+	n := 0
+	for i := 0; i < c || i < -c; i++ {
+		n |= int(r.next()) << (8 * uint(i))
+	}
+	if c < 0 {
+		n -= 1 << (8 * uint(-c))
+	}
+	return n
+}
+
+func (r *marshalReader) bytes() string {
+	n := r.long()
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
+
+func (r *marshalReader) symbol() string {
+	switch c := r.next(); c {
+	case ':':
+		s := r.bytes()
+		r.syms = append(r.syms, s)
+		return s
+	case ';':
+		return r.syms[r.long()]
+	default:
+		panic(fmt.Sprintf("expected symbol, got %q", c))
+	}
+}
+
+// object reserves the next object link for the value read by fn.
+func (r *marshalReader) object(fn func() string) string {
+	n := len(r.objs)
+	r.objs = append(r.objs, "")
+	r.objs[n] = fn()
+	return r.objs[n]
+}
+
+func (r *marshalReader) list(n int, fn func() string) string {
+	items := make([]string, n)
+	for i := range items {
+		items[i] = fn()
+	}
+	return strings.Join(items, ", ")
+}
+
+func (r *marshalReader) value() string {
+	switch c := r.next(); c {
+	case '0':
+		return "nil"
+	case 'T':
+		return "true"
+	case 'F':
+		return "false"
+	case 'i':
+		return strconv.Itoa(r.long())
+	case ':', ';':
+		r.b = append([]byte{c}, r.b...)
+		return ":" + r.symbol()
+	case '"':
+		return r.object(func() string { return strconv.Quote(r.bytes()) })
+	case 'I':
+		v := r.value()
+		r.list(r.long(), func() string { return r.symbol() + r.value() })
+		return v
+	case '[':
+		return r.object(func() string {
+			return "[" + r.list(r.long(), r.value) + "]"
+		})
+	case '{':
+		return r.object(func() string {
+			return "{" + r.list(r.long(), func() string { return r.value() + " => " + r.value() }) + "}"
+		})
+	case 'o':
+		return r.object(func() string {
+			class := r.symbol()
+			return "#<" + class + " " + r.list(r.long(), func() string { return r.symbol() + "=" + r.value() }) + ">"
+		})
+	case 'U':
+		return r.object(func() string {
+			class := r.symbol()
+			return class + "(" + r.value() + ")"
+		})
+	case 'u':
+		return r.object(func() string {
+			class := r.symbol()
+			return fmt.Sprintf("%s<%x>", class, r.bytes())
+		})
+	case '@':
+		return r.objs[r.long()]
+	default:
+		panic(fmt.Sprintf("unsupported type %q", c))
+	}
+}
+
+func TestSelectSpecs(t *testing.T) {
+	deps := []Metadata{
+		{Name: "foo", Number: "2.0.0.rc1", Platform: "ruby"},
+		{Name: "foo", Number: "1.2-1", Platform: "ruby"},
+		{Name: "foo", Number: "1.1.0", Platform: "ruby"},
+		{Name: "foo", Number: "1.0.0", Platform: "x86_64-linux"},
+		{Name: "foo", Number: "1.0.0", Platform: "ruby"},
+		{Name: "bar", Number: "0.1.0", Platform: ""},
+	}
+	tests := map[string][]string{
+		specsFile:           {"bar-0.1.0", "foo-1.0.0", "foo-1.0.0-x86_64-linux", "foo-1.1.0"},
+		latestSpecsFile:     {"bar-0.1.0", "foo-1.0.0-x86_64-linux", "foo-1.1.0"},
+		prereleaseSpecsFile: {"foo-1.2-1", "foo-2.0.0.rc1"},
+	}
+	for file, expected := range tests {
+		var names []string
+		for _, md := range selectSpecs(file, deps) {
+			names = append(names, md.FullName())
+		}
+		if strings.Join(names, " ") != strings.Join(expected, " ") {
+			t.Errorf("%s: got %v expected %v", file, names, expected)
+		}
+	}
+	if selected := selectSpecs("specs.4.8", deps); selected != nil {
+		t.Errorf("expected nil for unknown file; got %v", selected)
+	}
+}
+
+func TestIndexSpecs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStorage(dir)
+	idx, _ := LoadIndex(store, DependencyAPIEndpoint)
+
+	specs := func(file string) string {
+		b, err := idx.Specs(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := decodeMarshal(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	if s := specs(specsFile); s != "[]" {
+		t.Errorf("expected empty specs; got %s", s)
+	}
+	idx.Put(Metadata{Name: "foo", Number: "1.0.0", Platform: "ruby"})
+	idx.Put(Metadata{Name: "foo", Number: "1.1.0", Platform: "x86_64-linux"})
+	expected := `[["foo", Gem::Version(["1.0.0"]), "ruby"], ["foo", Gem::Version(["1.1.0"]), "x86_64-linux"]]`
+	if s := specs(specsFile); s != expected {
+		t.Errorf("invalid specs after put; got %s expected %s", s, expected)
+	}
+
+	idx.Delete("foo", "1.0.0", "ruby")
+	expected = `[["foo", Gem::Version(["1.1.0"]), "x86_64-linux"]]`
+	if s := specs(specsFile); s != expected {
+		t.Errorf("invalid specs after delete; got %s expected %s", s, expected)
+	}
+	if s := specs(latestSpecsFile); s != expected {
+		t.Errorf("invalid latest specs; got %s expected %s", s, expected)
+	}
+}
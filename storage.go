@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// ObjectInfo describes an object held by a Storage.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	Version      string
+	ContentType  string
+	LastModified time.Time
+}
+
+// Storage is an object store holding gems, their specs and the index.
+// Implementations return ErrObjectNotFound for keys that do not exist.
+type Storage interface {
+	// Get returns the contents of key, which the caller must close.
+	Get(key string) (io.ReadCloser, *ObjectInfo, error)
+	// GetRange is like Get but returns the contents from offset onwards.
+	GetRange(key string, offset int64) (io.ReadCloser, *ObjectInfo, error)
+	// Put stores the contents of r at key, replacing any existing object.
+	Put(key string, r io.Reader, contentType string) (*ObjectInfo, error)
+	// PutIfMatch is like Put but only replaces the object if its ETag is
+	// still etag. An empty etag requires that the key does not exist yet.
+	// ErrPreconditionFailed is returned when the condition does not hold.
+	PutIfMatch(key string, r io.Reader, contentType, etag string) (*ObjectInfo, error)
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(key string) error
+	// List returns the objects whose key starts with prefix.
+	List(prefix string) ([]ObjectInfo, error)
+	// Stat returns the attributes of key without its contents.
+	Stat(key string) (*ObjectInfo, error)
+}
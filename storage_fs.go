@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// tempPrefix marks files being written by fsStorage, which List ignores.
+	tempPrefix = ".tmp-"
+	// lockSuffix names the lock file guarding conditional writes of a key.
+	lockSuffix = ".lock"
+	// lockTimeout is how long a writer waits for the lock of a key.
+	lockTimeout = 30 * time.Second
+)
+
+// fsStorage stores objects as files below a local directory.
+type fsStorage struct {
+	root string
+}
+
+// NewFileStorage returns a Storage backed by the directory root.
+func NewFileStorage(root string) (Storage, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &fsStorage{root: root}, nil
+}
+
+func (s *fsStorage) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(filepath.Clean("/"+key)))
+}
+
+func (s *fsStorage) Get(key string) (io.ReadCloser, *ObjectInfo, error) {
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, nil, fsError(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, nil, ErrObjectNotFound
+	}
+	return f, fileInfo(key, fi), nil
+}
+
+func (s *fsStorage) GetRange(key string, offset int64) (io.ReadCloser, *ObjectInfo, error) {
+	rc, info, err := s.Get(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := rc.(*os.File).Seek(offset, io.SeekStart); err != nil {
+		rc.Close()
+		return nil, nil, err
+	}
+	return rc, info, nil
+}
+
+// Put writes r to a temporary file that replaces key once complete, so
+// readers never observe a partially written object.
+func (s *fsStorage) Put(key string, r io.Reader, contentType string) (*ObjectInfo, error) {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), tempPrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return nil, err
+	}
+	info, err := s.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	info.ContentType = contentType
+	return info, nil
+}
+
+// PutIfMatch holds a lock file next to key while comparing and replacing
+// it, so writers sharing the directory, such as replicas on a mounted
+// volume, cannot interleave.
+func (s *fsStorage) PutIfMatch(key string, r io.Reader, contentType, etag string) (*ObjectInfo, error) {
+	unlock, err := s.lock(key)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	info, err := s.Stat(key)
+	switch {
+	case err == ErrObjectNotFound:
+		if etag != "" {
+			return nil, ErrPreconditionFailed
+		}
+	case err != nil:
+		return nil, err
+	case info.ETag != etag:
+		return nil, ErrPreconditionFailed
+	}
+	return s.Put(key, r, contentType)
+}
+
+// lock takes an exclusive flock on the lock file of key, waiting for a
+// current holder to release it. The kernel releases the lock of a crashed
+// writer, so abandoned locks are never taken over by hand. Lock files are
+// left in place: removing one would let a writer still waiting on the old
+// file and a writer creating a new one both take the lock.
+func (s *fsStorage) lock(key string) (func(), error) {
+	path := s.path(key) + lockSuffix
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return func() {
+				syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+				f.Close()
+			}, nil
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, ErrPreconditionFailed
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (s *fsStorage) Delete(key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *fsStorage) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := filepath.Walk(s.root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), tempPrefix) || strings.HasSuffix(fi.Name(), lockSuffix) {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			objects = append(objects, *fileInfo(key, fi))
+		}
+		return nil
+	})
+	return objects, err
+}
+
+func (s *fsStorage) Stat(key string) (*ObjectInfo, error) {
+	fi, err := os.Stat(s.path(key))
+	if err != nil {
+		return nil, fsError(err)
+	}
+	if fi.IsDir() {
+		return nil, ErrObjectNotFound
+	}
+	return fileInfo(key, fi), nil
+}
+
+// fileInfo describes a stored file. The ETag changes whenever the file is
+// replaced, as each Put renames a new file into place.
+func fileInfo(key string, fi os.FileInfo) *ObjectInfo {
+	return &ObjectInfo{
+		Key:          key,
+		Size:         fi.Size(),
+		ETag:         fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()),
+		LastModified: fi.ModTime(),
+	}
+}
+
+func fsError(err error) error {
+	if os.IsNotExist(err) {
+		return ErrObjectNotFound
+	}
+	return err
+}
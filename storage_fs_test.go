@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Get("gems/missing.gem"); err != ErrObjectNotFound {
+		t.Errorf("expected ErrObjectNotFound; got %v", err)
+	}
+
+	info, err := store.Put("gems/foo-1.0.0.gem", strings.NewReader("gem"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 3 || info.ETag == "" {
+		t.Errorf("invalid object info: %+v", info)
+	}
+
+	rc, _, err := store.Get("gems/foo-1.0.0.gem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(b) != "gem" {
+		t.Errorf("invalid contents; got: %q expected %q", b, "gem")
+	}
+
+	store.Put("quick/Marshal.4.8/foo-1.0.0.gemspec.rz", strings.NewReader("spec"), "")
+	objects, err := store.List("gems/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "gems/foo-1.0.0.gem" {
+		t.Errorf("invalid list: %+v", objects)
+	}
+
+	if err := store.Delete("gems/foo-1.0.0.gem"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat("gems/foo-1.0.0.gem"); err != ErrObjectNotFound {
+		t.Errorf("expected ErrObjectNotFound; got %v", err)
+	}
+	if err := store.Delete("gems/foo-1.0.0.gem"); err != nil {
+		t.Errorf("deleting a missing key: %v", err)
+	}
+}
+
+func TestFileStoragePutIfMatchConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a lock file left behind by a crashed writer holds no lock
+	first, _ := NewFileStorage(dir)
+	ioutil.WriteFile(first.(*fsStorage).path("index.json")+lockSuffix, nil, 0644)
+
+	// each writer stands in for a separate replica creating the same key
+	var (
+		wg   sync.WaitGroup
+		won  int32
+		errs = make(chan error, 10)
+	)
+	for n := 0; n < 10; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store, _ := NewFileStorage(dir)
+			_, err := store.PutIfMatch("index.json", strings.NewReader("{}"), "", "")
+			switch err {
+			case nil:
+				atomic.AddInt32(&won, 1)
+			case ErrPreconditionFailed:
+			default:
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if won != 1 {
+		t.Errorf("expected exactly one writer to create the key; got %d", won)
+	}
+}
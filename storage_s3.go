@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// s3Storage stores objects in an S3 bucket.
+type s3Storage struct {
+	svc      *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+}
+
+// NewS3Storage returns a Storage backed by bucket.
+func NewS3Storage(svc *s3.S3, bucket string) Storage {
+	return &s3Storage{
+		svc:      svc,
+		uploader: s3manager.NewUploaderWithClient(svc),
+		bucket:   bucket,
+	}
+}
+
+func (s *s3Storage) Get(key string) (io.ReadCloser, *ObjectInfo, error) {
+	return s.GetRange(key, 0)
+}
+
+func (s *s3Storage) GetRange(key string, offset int64) (io.ReadCloser, *ObjectInfo, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+	res, err := s.svc.GetObject(input)
+	if err != nil {
+		return nil, nil, s3Error(err)
+	}
+	size := aws.Int64Value(res.ContentLength)
+	// a ranged response is sized by Content-Range: bytes first-last/size
+	if cr := aws.StringValue(res.ContentRange); cr != "" {
+		if n, err := strconv.ParseInt(cr[strings.LastIndex(cr, "/")+1:], 10, 64); err == nil {
+			size = n
+		}
+	}
+	return res.Body, &ObjectInfo{
+		Key:          key,
+		Size:         size,
+		ETag:         aws.StringValue(res.ETag),
+		Version:      aws.StringValue(res.VersionId),
+		ContentType:  aws.StringValue(res.ContentType),
+		LastModified: aws.TimeValue(res.LastModified),
+	}, nil
+}
+
+func (s *s3Storage) PresignGet(key string, ttl time.Duration) (string, error) {
+	req, _ := s.svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return req.Presign(ttl)
+}
+
+// Put streams r to key, using a multipart upload for large objects so
+// they are never held in memory.
+func (s *s3Storage) Put(key string, r io.Reader, contentType string) (*ObjectInfo, error) {
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   r,
+	}
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+	if _, err := s.uploader.Upload(input); err != nil {
+		return nil, s3Error(err)
+	}
+	return s.Stat(key)
+}
+
+// PutIfMatch uses S3 conditional writes, sending If-Match for an existing
+// object or If-None-Match for a new one. Like Put, large objects are sent
+// as a multipart upload, whose completion carries the condition.
+func (s *s3Storage) PutIfMatch(key string, r io.Reader, contentType, etag string) (*ObjectInfo, error) {
+	info := &ObjectInfo{Key: key, ContentType: contentType}
+	conditional := func(req *request.Request) {
+		switch req.Operation.Name {
+		case "PutObject", "CompleteMultipartUpload":
+		default:
+			return
+		}
+		if etag == "" {
+			req.HTTPRequest.Header.Set("If-None-Match", "*")
+		} else {
+			req.HTTPRequest.Header.Set("If-Match", etag)
+		}
+		// the ETag written is only returned by the request completing
+		// the upload, and must not be read back as another writer may
+		// have replaced the object since
+		req.Handlers.Complete.PushBack(func(req *request.Request) {
+			switch out := req.Data.(type) {
+			case *s3.PutObjectOutput:
+				info.ETag, info.Version = aws.StringValue(out.ETag), aws.StringValue(out.VersionId)
+			case *s3.CompleteMultipartUploadOutput:
+				info.ETag, info.Version = aws.StringValue(out.ETag), aws.StringValue(out.VersionId)
+			}
+		})
+	}
+
+	body := &countingReader{r: r}
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	}
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+	if _, err := s.uploader.Upload(input, s3manager.WithUploaderRequestOptions(conditional)); err != nil {
+		return nil, s3Error(err)
+	}
+	info.Size = body.n
+	return info, nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (s *s3Storage) Delete(key string) error {
+	_, err := s.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return s3Error(err)
+}
+
+func (s *s3Storage) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := s.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, obj := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.StringValue(obj.Key),
+				Size:         aws.Int64Value(obj.Size),
+				ETag:         aws.StringValue(obj.ETag),
+				LastModified: aws.TimeValue(obj.LastModified),
+			})
+		}
+		return true
+	})
+	return objects, s3Error(err)
+}
+
+func (s *s3Storage) Stat(key string) (*ObjectInfo, error) {
+	res, err := s.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(res.ContentLength),
+		ETag:         aws.StringValue(res.ETag),
+		Version:      aws.StringValue(res.VersionId),
+		ContentType:  aws.StringValue(res.ContentType),
+		LastModified: aws.TimeValue(res.LastModified),
+	}, nil
+}
+
+// s3Error translates missing key errors to ErrObjectNotFound and failed
+// conditional writes to ErrPreconditionFailed. HeadObject reports a missing
+// key only through the status code.
+func s3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	if merr, ok := err.(s3manager.MultiUploadFailure); ok && merr.OrigErr() != nil {
+		err = merr.OrigErr()
+	}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return ErrObjectNotFound
+	}
+	if rerr, ok := err.(awserr.RequestFailure); ok {
+		switch rerr.StatusCode() {
+		case http.StatusNotFound:
+			return ErrObjectNotFound
+		case http.StatusPreconditionFailed:
+			return ErrPreconditionFailed
+		case http.StatusConflict:
+			if rerr.Code() == "ConditionalRequestConflict" {
+				return ErrPreconditionFailed
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fakeS3 implements the S3 object writes used by s3Storage, honoring
+// If-None-Match on PutObject and CompleteMultipartUpload.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	parts   map[string][]byte
+	// conditional lists the requests sent with If-None-Match
+	conditional []string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	q := r.URL.Query()
+	key := r.URL.Path
+	if r.Header.Get("If-None-Match") != "" {
+		f.conditional = append(f.conditional, r.Method+" "+r.URL.RawQuery)
+	}
+	precondition := func() bool {
+		if _, ok := f.objects[key]; ok && r.Header.Get("If-None-Match") == "*" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprint(w, `<Error><Code>PreconditionFailed</Code></Error>`)
+			return false
+		}
+		return true
+	}
+
+	switch {
+	case r.Method == "POST" && q["uploads"] != nil:
+		fmt.Fprint(w, `<InitiateMultipartUploadResult><UploadId>1</UploadId></InitiateMultipartUploadResult>`)
+	case r.Method == "PUT" && q.Get("partNumber") != "":
+		f.parts[key] = append(f.parts[key], body...)
+		w.Header().Set("ETag", `"part`+q.Get("partNumber")+`"`)
+	case r.Method == "POST" && q.Get("uploadId") != "":
+		if precondition() {
+			f.objects[key] = f.parts[key]
+			delete(f.parts, key)
+			fmt.Fprint(w, `<CompleteMultipartUploadResult><ETag>"multipart"</ETag></CompleteMultipartUploadResult>`)
+		}
+	case r.Method == "DELETE":
+		delete(f.parts, key)
+	case r.Method == "PUT":
+		if precondition() {
+			f.objects[key] = body
+			w.Header().Set("ETag", `"single"`)
+		}
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func TestS3StoragePutIfMatch(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte), parts: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+	}))
+	store := NewS3Storage(s3.New(sess), "bucket")
+
+	info, err := store.PutIfMatch("index.json", strings.NewReader("{}"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ETag != `"single"` || info.Size != 2 {
+		t.Errorf("invalid object info %+v", info)
+	}
+	if _, err := store.PutIfMatch("index.json", strings.NewReader("{}"), "", ""); err != ErrPreconditionFailed {
+		t.Errorf("expected ErrPreconditionFailed; got %v", err)
+	}
+
+	// larger than a part, so sent as a multipart upload
+	gem := bytes.Repeat([]byte("x"), 6<<20)
+	fake.conditional = nil
+	info, err = store.PutIfMatch("gems/foo-1.0.0.gem", bytes.NewReader(gem), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ETag != `"multipart"` || info.Size != int64(len(gem)) {
+		t.Errorf("invalid object info %+v", info)
+	}
+	if !bytes.Equal(fake.objects["/bucket/gems/foo-1.0.0.gem"], gem) {
+		t.Error("invalid uploaded object")
+	}
+	if len(fake.conditional) != 1 || !strings.HasPrefix(fake.conditional[0], "POST uploadId=") {
+		t.Errorf("expected only the completion to be conditional; got %v", fake.conditional)
+	}
+	if _, err := store.PutIfMatch("gems/foo-1.0.0.gem", bytes.NewReader(gem), "", ""); err != ErrPreconditionFailed {
+		t.Errorf("expected ErrPreconditionFailed; got %v", err)
+	}
+}
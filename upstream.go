@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// staleWarning marks responses built from stored copies of upstream files
+// because the upstream source could not be reached.
+const staleWarning = `110 gemserve "Response is Stale"`
+
+// upstream is a remote gem source serving the compact index.
+type upstream struct {
+	name   string
+	client http.Client
+	// gemClient downloads gems, which may take longer than client allows
+	gemClient http.Client
+	base      string
+	// username and password authenticate requests when set
+	username string
+	password string
+	header   http.Header
+	// cache keeps the files fetched, serving them while they are fresh or
+	// the source is unavailable. Nil disables caching.
+	cache *metadataCache
+}
+
+// Versions returns the upstream compact index versions file. The file is
+// stale if it is a stored copy, served as the source is unavailable.
+func (u *upstream) Versions() (body []byte, stale bool, err error) {
+	return u.fetch("/versions")
+}
+
+// Info returns the upstream compact index info file for name.
+// ErrUpstreamNotFound is returned when the source does not know the gem.
+func (u *upstream) Info(name string) (body []byte, stale bool, err error) {
+	return u.fetch("/info/" + name)
+}
+
+// fetch returns the upstream file at path, from the cache when it is
+// fresh or the source cannot be reached.
+func (u *upstream) fetch(path string) (body []byte, stale bool, err error) {
+	if u.cache == nil {
+		body, err = u.get(path)
+		return body, false, err
+	}
+	return u.cache.Get(u.cachePath(path), func() ([]byte, error) {
+		return u.get(path)
+	})
+}
+
+// cachePath namespaces path by the source in the cache.
+func (u *upstream) cachePath(path string) string {
+	if u.name == "" {
+		return path
+	}
+	return "/" + u.name + path
+}
+
+// newRequest returns a request for path, authenticated for the source.
+func (u *upstream) newRequest(method, path string) (*http.Request, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(u.base, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	u.authorize(req)
+	return req, nil
+}
+
+// authorize adds the credentials and headers of the source to req.
+func (u *upstream) authorize(req *http.Request) {
+	if u.username != "" || u.password != "" {
+		req.SetBasicAuth(u.username, u.password)
+	}
+	for k, v := range u.header {
+		req.Header[k] = v
+	}
+}
+
+func (u *upstream) get(path string) ([]byte, error) {
+	req, err := u.newRequest(http.MethodGet, path)
+	if err != nil {
+		return nil, err
+	}
+	res, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrUpstreamNotFound
+	default:
+		return nil, fmt.Errorf("upstream %s: unexpected status %s", path, res.Status)
+	}
+	return ioutil.ReadAll(res.Body)
+}
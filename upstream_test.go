@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestUpstreamStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStorage(dir)
+
+	down := false
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case down:
+			http.Error(w, "", http.StatusServiceUnavailable)
+		case r.URL.Path == "/info/rack":
+			w.Write([]byte("---\n2.0.0 |checksum:abc\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer source.Close()
+	up := &upstream{base: source.URL, cache: newMetadataCache(store, 0, 0, 1<<20)}
+
+	body, stale, err := up.Info("rack")
+	if err != nil || stale {
+		t.Fatalf("expected fresh info; got stale %v, %v", stale, err)
+	}
+
+	down = true
+	cached, stale, err := up.Info("rack")
+	if err != nil || !stale || string(cached) != string(body) {
+		t.Errorf("expected stored copy; got %q, stale %v, %v", cached, stale, err)
+	}
+	if _, _, err := up.Info("rails"); err == nil {
+		t.Error("expected error without a stored copy")
+	}
+
+	down = false
+	if _, _, err := up.Info("rails"); err != ErrUpstreamNotFound {
+		t.Errorf("expected unknown gem to be not found; got %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ChangeSource notifies an Index that the persisted index may have been
+// changed by another replica, e.g. by polling or from bucket notifications.
+type ChangeSource interface {
+	Changes() <-chan struct{}
+}
+
+// pollSource reports a possible change on every tick.
+type pollSource struct {
+	c chan struct{}
+}
+
+// NewPollSource returns a ChangeSource that fires every interval.
+func NewPollSource(interval time.Duration) ChangeSource {
+	src := &pollSource{c: make(chan struct{})}
+	go func() {
+		for range time.Tick(interval) {
+			src.c <- struct{}{}
+		}
+	}()
+	return src
+}
+
+func (p *pollSource) Changes() <-chan struct{} {
+	return p.c
+}
+
+// Watch syncs the index whenever src reports a change, until stop is closed.
+func (i *Index) Watch(src ChangeSource, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-src.Changes():
+			if err := i.Sync(); err != nil {
+				logrus.WithError(err).Error("index sync failed")
+			}
+		}
+	}
+}
+
+// Sync reloads the index if the persisted ETag differs from the one in
+// memory. The index is loaded without holding the lock and swapped in
+// only if no local write happened meanwhile.
+func (i *Index) Sync() error {
+	i.mu.Lock()
+	etag := i.etag
+	i.mu.Unlock()
+
+	info, err := i.store.Stat(i.keyJSON())
+	if err != nil && err != ErrObjectNotFound {
+		return err
+	}
+	if (info == nil && etag == "") || (info != nil && info.ETag == etag) {
+		i.mu.Lock()
+		i.checked = time.Now()
+		i.mu.Unlock()
+		return nil
+	}
+
+	gems, info, err := i.load()
+	if err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.etag == etag {
+		i.apply(gems, info)
+	}
+	return nil
+}
+
+// Age returns how long ago the index was last known to be current.
+func (i *Index) Age() time.Duration {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return time.Since(i.checked)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// yankedPrefix holds the objects of yanked gems. A yanked version cannot be
+// pushed again, and Reindex leaves it out.
+const yankedPrefix = "yanked/"
+
+// Yank removes the gem from the index and moves its objects below
+// yankedPrefix. The yanked copy is made before the gem is removed from the
+// index, so a gem left under gems/ by a failed yank is still left out when
+// reindexing.
+func (i *Index) Yank(name, version, platform string) error {
+	i.mu.Lock()
+	var gem Metadata
+	_, md := i.find(name, version, platform)
+	if md != nil {
+		gem = *md
+	}
+	i.mu.Unlock()
+	if md == nil {
+		return errors.New("gem not found")
+	}
+
+	full := gem.FullName()
+	keys := []string{gemKey(full), gemspecKey(full)}
+	for _, key := range keys {
+		if err := i.copy(key, yankedPrefix); err != nil {
+			return err
+		}
+	}
+	if err := i.Delete(gem.Name, gem.Number, gem.Platform); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := i.store.Delete(key); err != nil {
+			logrus.WithError(err).WithField("key", key).Warn("failed to remove yanked object")
+		}
+	}
+	return nil
+}
+
+// yanked reports whether the gem with the full name was yanked.
+func (i *Index) yanked(name string) (bool, error) {
+	_, err := i.store.Stat(yankedPrefix + gemKey(name))
+	if err == ErrObjectNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// copy copies the object at key below prefix. Missing objects are skipped.
+func (i *Index) copy(key, prefix string) error {
+	rc, info, err := i.store.Get(key)
+	if err == ErrObjectNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = i.store.Put(prefix+key, rc, info.ContentType)
+	return err
+}
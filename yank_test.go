@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestIndexYank(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStorage(dir)
+	idx, _ := LoadIndex(store, DependencyAPIEndpoint)
+
+	raw := buildGem(t, "testdata/sinatra-metadata.yaml")
+	gem, err := LoadGem(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idx.Push(gem, bytes.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Yank("sinatra", "2.0.0", ""); err != nil {
+		t.Fatal(err)
+	}
+	if deps := idx.Lookup("sinatra"); len(deps) != 0 {
+		t.Errorf("expected yanked gem to be unindexed; got %v", deps)
+	}
+	if _, err := store.Stat(gemKey("sinatra-2.0.0")); err != ErrObjectNotFound {
+		t.Errorf("expected yanked gem to be moved; got %v", err)
+	}
+	if _, err := store.Stat(yankedPrefix + gemKey("sinatra-2.0.0")); err != nil {
+		t.Errorf("expected yanked copy; got %v", err)
+	}
+
+	diff, err := idx.Reindex(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.Empty() {
+		t.Errorf("expected reindex to leave out the yanked gem; got %+v", diff)
+	}
+	// a yank interrupted before removing the gem
+	store.Put(gemKey("sinatra-2.0.0"), bytes.NewReader(raw), "")
+	if diff, err := idx.Reindex(true); err != nil || !diff.Empty() {
+		t.Errorf("expected reindex to leave out the yanked gem; got %+v %v", diff, err)
+	}
+	store.Delete(gemKey("sinatra-2.0.0"))
+
+	if _, err := idx.Push(gem, bytes.NewReader(raw)); err != ErrDuplicateGem {
+		t.Errorf("expected yanked version to be a duplicate; got %v", err)
+	}
+}